@@ -0,0 +1,380 @@
+package pgxshard
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// AggregateFunc is an aggregate function whose partial results, computed on
+// every shard, can be merged.
+type AggregateFunc int
+
+const (
+	// AggCount merges partial counts by adding them.
+	AggCount AggregateFunc = iota
+	// AggSum merges partial sums by adding them.
+	AggSum
+	// AggMin merges partial minimums by keeping the smallest one.
+	AggMin
+	// AggMax merges partial maximums by keeping the largest one.
+	AggMax
+	// AggAvg merges averages from a partial sum and a partial count, which
+	// take two consecutive columns.
+	AggAvg
+)
+
+// PartialAvg is the partial result of an average computed on one shard.
+type PartialAvg struct {
+	Sum   float64
+	Count int64
+}
+
+// MergeCount merges partial counts.
+func MergeCount(parts ...int64) int64 {
+	var n int64
+	for _, p := range parts {
+		n += p
+	}
+	return n
+}
+
+// MergeSum merges partial sums.
+func MergeSum[T int64 | float64](parts ...T) T {
+	var sum T
+	for _, p := range parts {
+		sum += p
+	}
+	return sum
+}
+
+// MergeNumericSum merges partial numeric sums exactly. NaN parts make the sum
+// NaN, as do infinite parts of opposite signs. It returns false if there are
+// no valid parts.
+func MergeNumericSum(parts ...pgtype.Numeric) (pgtype.Numeric, bool) {
+	var (
+		sum      pgtype.Numeric
+		posInf   bool
+		negInf   bool
+		nan      bool
+		anyValid bool
+	)
+	for _, p := range parts {
+		if !p.Valid {
+			continue
+		}
+		anyValid = true
+		switch {
+		case p.NaN:
+			nan = true
+			continue
+		case p.InfinityModifier == pgtype.Infinity:
+			posInf = true
+			continue
+		case p.InfinityModifier == pgtype.NegativeInfinity:
+			negInf = true
+			continue
+		}
+		sum = addNumeric(sum, p)
+	}
+
+	switch {
+	case !anyValid:
+		return pgtype.Numeric{}, false
+	case nan || (posInf && negInf):
+		return pgtype.Numeric{NaN: true, Valid: true}, true
+	case posInf:
+		return pgtype.Numeric{InfinityModifier: pgtype.Infinity, Valid: true}, true
+	case negInf:
+		return pgtype.Numeric{InfinityModifier: pgtype.NegativeInfinity, Valid: true}, true
+	}
+	return sum, true
+}
+
+// addNumeric returns the exact sum of the finite numerics a and b, a being
+// the zero Numeric for a sum of nothing yet.
+func addNumeric(a, b pgtype.Numeric) pgtype.Numeric {
+	if !a.Valid {
+		return pgtype.Numeric{Int: new(big.Int).Set(b.Int), Exp: b.Exp, Valid: true}
+	}
+
+	exp := min(a.Exp, b.Exp)
+	sum := new(big.Int).Add(scaleNumeric(a, exp), scaleNumeric(b, exp))
+	return pgtype.Numeric{Int: sum, Exp: exp, Valid: true}
+}
+
+// scaleNumeric returns the integer n such that n * 10^exp equals v, exp being
+// at most v.Exp.
+func scaleNumeric(v pgtype.Numeric, exp int32) *big.Int {
+	n := new(big.Int)
+	if v.Int != nil {
+		n.Set(v.Int)
+	}
+	if v.Exp > exp {
+		n.Mul(n, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(v.Exp-exp)), nil))
+	}
+	return n
+}
+
+// toNumeric converts an integer or numeric value to a Numeric.
+func toNumeric(v any) (pgtype.Numeric, bool) {
+	if n, ok := v.(pgtype.Numeric); ok {
+		return n, true
+	}
+	if i, ok := toInt64(v); ok {
+		return pgtype.Numeric{Int: big.NewInt(i), Valid: true}, true
+	}
+	return pgtype.Numeric{}, false
+}
+
+// avgScale is the number of fractional digits of averages of numeric sums.
+const avgScale = 16
+
+// divNumeric returns sum / count rounded half away from zero to avgScale
+// fractional digits, or sum itself if it is not finite.
+func divNumeric(sum pgtype.Numeric, count int64) pgtype.Numeric {
+	if sum.NaN || sum.InfinityModifier != pgtype.Finite {
+		return sum
+	}
+
+	r := new(big.Rat).SetFrac(scaleNumeric(sum, min(sum.Exp, 0)), big.NewInt(count))
+	if sum.Exp < 0 {
+		r.Quo(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-sum.Exp)), nil)))
+	}
+	r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(avgScale), nil)))
+
+	// Round half away from zero.
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(m), big.NewInt(2)).Cmp(r.Denom()) >= 0 {
+		if r.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return pgtype.Numeric{Int: q, Exp: -avgScale, Valid: true}
+}
+
+// MergeMin merges partial minimums. It returns false if there are no parts.
+func MergeMin[T cmp.Ordered](parts ...T) (T, bool) {
+	if len(parts) == 0 {
+		var zero T
+		return zero, false
+	}
+	m := parts[0]
+	for _, p := range parts[1:] {
+		m = min(m, p)
+	}
+	return m, true
+}
+
+// MergeMax merges partial maximums. It returns false if there are no parts.
+func MergeMax[T cmp.Ordered](parts ...T) (T, bool) {
+	if len(parts) == 0 {
+		var zero T
+		return zero, false
+	}
+	m := parts[0]
+	for _, p := range parts[1:] {
+		m = max(m, p)
+	}
+	return m, true
+}
+
+// MergeAvg merges partial averages. It returns false if no rows were counted.
+func MergeAvg(parts ...PartialAvg) (float64, bool) {
+	var total PartialAvg
+	for _, p := range parts {
+		total.Sum += p.Sum
+		total.Count += p.Count
+	}
+	if total.Count == 0 {
+		return 0, false
+	}
+	return total.Sum / float64(total.Count), true
+}
+
+// QueryAggregate executes sql, which must return a single row of partial
+// aggregates, on every shard and merges the partial results of all shards
+// according to aggs. Every function in aggs takes one column, except AggAvg
+// which takes a sum column followed by a count column, so for
+//
+//	SELECT count(*), sum(total), max(total), sum(total), count(total) FROM orders
+//
+// aggs is AggCount, AggSum, AggMax, AggAvg. It returns one merged value per
+// function: an int64 for AggCount, an int64, float64 or pgtype.Numeric for
+// AggSum, the column's type for AggMin and AggMax and a float64 for AggAvg,
+// or a pgtype.Numeric if the sums are numeric. Numeric sums, such as the
+// sum of a bigint or numeric column, are merged exactly. Merged values
+// over no rows are nil, except counts. Shard failures are handled according
+// to the configured failure policy, and shards that failed are left out of
+// the merged values.
+func (s *ShardManager) QueryAggregate(ctx context.Context, aggs []AggregateFunc, sql string, args ...any) ([]any, error) {
+	t := s.readTopology()
+
+	parts := make([][]any, len(t.pools))
+	_, err := s.forEachShard(ctx, t, func(ctx context.Context, i int) error {
+		rows, err := t.pools[i].Query(ctx, sql, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return errors.New("aggregate query returned no rows")
+		}
+		parts[i], err = rows.Values()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Shards that failed under the failure policy have no partial results.
+	var succeeded [][]any
+	for _, p := range parts {
+		if p != nil {
+			succeeded = append(succeeded, p)
+		}
+	}
+
+	return mergeAggregates(aggs, succeeded)
+}
+
+// mergeAggregates merges the partial aggregate rows of every shard.
+func mergeAggregates(aggs []AggregateFunc, parts [][]any) ([]any, error) {
+	result := make([]any, len(aggs))
+	col := 0
+	for i, agg := range aggs {
+		width := 1
+		if agg == AggAvg {
+			width = 2
+		}
+		for _, p := range parts {
+			if len(p) < col+width {
+				return nil, fmt.Errorf("aggregate query returned %d columns, expected at least %d", len(p), col+width)
+			}
+		}
+
+		var err error
+		result[i], err = mergeAggregate(agg, parts, col)
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge column %d: %w", col+1, err)
+		}
+		col += width
+	}
+
+	return result, nil
+}
+
+// mergeAggregate merges the partial results of agg found at column col.
+func mergeAggregate(agg AggregateFunc, parts [][]any, col int) (any, error) {
+	switch agg {
+	case AggCount:
+		var counts []int64
+		for _, p := range parts {
+			n, ok := toInt64(p[col])
+			if !ok {
+				return nil, fmt.Errorf("count is a %T", p[col])
+			}
+			counts = append(counts, n)
+		}
+		return MergeCount(counts...), nil
+
+	case AggSum:
+		var ints []int64
+		var floats []float64
+		var numerics []pgtype.Numeric
+		for _, p := range parts {
+			if p[col] == nil {
+				continue
+			}
+			if n, ok := toInt64(p[col]); ok {
+				ints = append(ints, n)
+			}
+			if n, ok := toNumeric(p[col]); ok {
+				numerics = append(numerics, n)
+			}
+			f, ok := toFloat64(p[col])
+			if !ok {
+				return nil, fmt.Errorf("sum is a %T", p[col])
+			}
+			floats = append(floats, f)
+		}
+		switch {
+		case len(floats) == 0:
+			return nil, nil
+		case len(ints) == len(floats):
+			return MergeSum(ints...), nil
+		case len(numerics) == len(floats):
+			sum, _ := MergeNumericSum(numerics...)
+			return sum, nil
+		}
+		return MergeSum(floats...), nil
+
+	case AggMin, AggMax:
+		var best any
+		for _, p := range parts {
+			if p[col] == nil {
+				continue
+			}
+			if best == nil {
+				best = p[col]
+				continue
+			}
+			c, err := compareValues(p[col], best)
+			if err != nil {
+				return nil, err
+			}
+			if (agg == AggMin && c < 0) || (agg == AggMax && c > 0) {
+				best = p[col]
+			}
+		}
+		return best, nil
+
+	case AggAvg:
+		var avgs []PartialAvg
+		var numerics []pgtype.Numeric
+		exact := true
+		for _, p := range parts {
+			if p[col] == nil {
+				continue
+			}
+			sum, ok := toFloat64(p[col])
+			if !ok {
+				return nil, fmt.Errorf("sum is a %T", p[col])
+			}
+			count, ok := toInt64(p[col+1])
+			if !ok {
+				return nil, fmt.Errorf("count is a %T", p[col+1])
+			}
+			avgs = append(avgs, PartialAvg{Sum: sum, Count: count})
+
+			n, ok := p[col].(pgtype.Numeric)
+			exact = exact && ok
+			numerics = append(numerics, n)
+		}
+		avg, ok := MergeAvg(avgs...)
+		if !ok {
+			return nil, nil
+		}
+		if exact {
+			sum, _ := MergeNumericSum(numerics...)
+			var count int64
+			for _, a := range avgs {
+				count += a.Count
+			}
+			return divNumeric(sum, count), nil
+		}
+		return avg, nil
+	}
+
+	return nil, fmt.Errorf("unknown aggregate function %d", agg)
+}
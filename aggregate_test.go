@@ -0,0 +1,179 @@
+package pgxshard
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// numeric parses s as a numeric, or returns an invalid numeric for "NULL".
+// Integers with a positive exponent, such as "1e3", keep it as their Exp.
+func numeric(t *testing.T, s string) pgtype.Numeric {
+	t.Helper()
+
+	var n pgtype.Numeric
+	if s == "NULL" {
+		return n
+	}
+	if m, e, ok := strings.Cut(s, "e"); ok {
+		i, ok := new(big.Int).SetString(m, 10)
+		exp, err := strconv.Atoi(e)
+		if !ok || err != nil {
+			t.Fatalf("invalid numeric %q", s)
+		}
+		return pgtype.Numeric{Int: i, Exp: int32(exp), Valid: true}
+	}
+	if err := n.Scan(s); err != nil {
+		t.Fatalf("Scan(%q): %v", s, err)
+	}
+	return n
+}
+
+// numericString returns the text form of n.
+func numericString(t *testing.T, n pgtype.Numeric) string {
+	t.Helper()
+
+	v, err := n.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == nil {
+		return "NULL"
+	}
+	return v.(string)
+}
+
+func TestMergeNumericSum(t *testing.T) {
+	tests := []struct {
+		parts  []string
+		want   string
+		wantOK bool
+	}{
+		{[]string{"12345678901234567.89", "100.01"}, "12345678901234667.90", true},
+		{[]string{"0.1", "0.2", "-0.3"}, "0.0", true},
+		{[]string{"1e3", "NULL", "5"}, "1005", true},
+		{[]string{"1", "NaN"}, "NaN", true},
+		{[]string{"1", "Infinity"}, "Infinity", true},
+		{[]string{"-Infinity", "1"}, "-Infinity", true},
+		{[]string{"Infinity", "-Infinity"}, "NaN", true},
+		{[]string{"NULL", "NULL"}, "NULL", false},
+		{nil, "NULL", false},
+	}
+	for _, tt := range tests {
+		parts := make([]pgtype.Numeric, len(tt.parts))
+		for i, p := range tt.parts {
+			parts[i] = numeric(t, p)
+		}
+
+		got, ok := MergeNumericSum(parts...)
+		if ok != tt.wantOK {
+			t.Errorf("MergeNumericSum(%v) ok = %t, want %t", tt.parts, ok, tt.wantOK)
+			continue
+		}
+		if s := numericString(t, got); s != tt.want {
+			t.Errorf("MergeNumericSum(%v) = %s, want %s", tt.parts, s, tt.want)
+		}
+	}
+}
+
+func TestDivNumeric(t *testing.T) {
+	tests := []struct {
+		sum   string
+		count int64
+		want  string
+	}{
+		{"12345678901234667.90", 3, "4115226300411555.9666666666666667"},
+		{"115.10", 6, "19.1833333333333333"},
+		{"-1", 6, "-0.1666666666666667"},
+		{"-1", 3, "-0.3333333333333333"},
+		{"2e2", 8, "25.0000000000000000"},
+		{"NaN", 2, "NaN"},
+		{"Infinity", 2, "Infinity"},
+	}
+	for _, tt := range tests {
+		if got := numericString(t, divNumeric(numeric(t, tt.sum), tt.count)); got != tt.want {
+			t.Errorf("divNumeric(%s, %d) = %s, want %s", tt.sum, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestMergeAggregates(t *testing.T) {
+	aggs := []AggregateFunc{AggCount, AggSum, AggMin, AggMax, AggAvg, AggAvg}
+	parts := [][]any{
+		{int64(2), int64(10), int32(4), "b", numeric(t, "10.50"), int64(2), 1.5, int64(1)},
+		{int64(3), numeric(t, "0.25"), int32(-1), "c", numeric(t, "4.60"), int64(4), nil, int64(0)},
+		{int64(0), nil, nil, nil, nil, int64(0), 4.5, int64(2)},
+	}
+
+	got, err := mergeAggregates(aggs, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got[0] != int64(5) {
+		t.Errorf("count = %#v, want 5", got[0])
+	}
+	if sum, ok := got[1].(pgtype.Numeric); !ok || numericString(t, sum) != "10.25" {
+		t.Errorf("sum = %#v, want numeric 10.25", got[1])
+	}
+	if got[2] != int32(-1) {
+		t.Errorf("min = %#v, want -1", got[2])
+	}
+	if got[3] != "c" {
+		t.Errorf("max = %#v, want c", got[3])
+	}
+	if avg, ok := got[4].(pgtype.Numeric); !ok || numericString(t, avg) != "2.5166666666666667" {
+		t.Errorf("numeric avg = %#v, want numeric 2.5166666666666667", got[4])
+	}
+	if got[5] != 2.0 {
+		t.Errorf("float avg = %#v, want 2", got[5])
+	}
+}
+
+func TestMergeAggregatesSums(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []any
+		want  any
+	}{
+		{"ints", []any{int64(1), int32(2)}, int64(3)},
+		{"floats", []any{1.5, int64(2)}, 3.5},
+		{"no rows", []any{nil, nil}, nil},
+	}
+	for _, tt := range tests {
+		parts := make([][]any, len(tt.parts))
+		for i, p := range tt.parts {
+			parts[i] = []any{p}
+		}
+
+		got, err := mergeAggregates([]AggregateFunc{AggSum}, parts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got[0] != tt.want {
+			t.Errorf("%s: sum = %#v, want %#v", tt.name, got[0], tt.want)
+		}
+	}
+}
+
+func TestMergeAggregatesErrors(t *testing.T) {
+	tests := []struct {
+		aggs    []AggregateFunc
+		parts   [][]any
+		wantErr string
+	}{
+		{[]AggregateFunc{AggAvg}, [][]any{{1.5}}, "expected at least 2"},
+		{[]AggregateFunc{AggCount}, [][]any{{"x"}}, "count is a string"},
+		{[]AggregateFunc{AggSum}, [][]any{{"x"}}, "sum is a string"},
+		{[]AggregateFunc{AggMin}, [][]any{{int64(1)}, {"x"}}, "cannot compare"},
+		{[]AggregateFunc{AggregateFunc(42)}, [][]any{{int64(1)}}, "unknown aggregate function"},
+	}
+	for _, tt := range tests {
+		if _, err := mergeAggregates(tt.aggs, tt.parts); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("mergeAggregates(%v, %v) error = %v, want one containing %q", tt.aggs, tt.parts, err, tt.wantErr)
+		}
+	}
+}
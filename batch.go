@@ -0,0 +1,231 @@
+package pgxshard
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ShardedBatch is a batch of statements, each routed to the shard of its key.
+// See ShardManager.SendBatch.
+type ShardedBatch struct {
+	queries []*ShardedQueuedQuery
+}
+
+// ShardedQueuedQuery is a statement queued in a ShardedBatch.
+type ShardedQueuedQuery struct {
+	Key       any
+	SQL       string
+	Arguments []any
+
+	fn func(br pgx.BatchResults, res *BatchResult) error
+}
+
+// Queue queues a statement to run on the shard for key.
+func (b *ShardedBatch) Queue(key any, query string, arguments ...any) *ShardedQueuedQuery {
+	q := &ShardedQueuedQuery{Key: key, SQL: query, Arguments: arguments}
+	b.queries = append(b.queries, q)
+	return q
+}
+
+// Len returns the number of statements queued.
+func (b *ShardedBatch) Len() int {
+	return len(b.queries)
+}
+
+// Query sets fn to be called with the rows of the statement.
+func (q *ShardedQueuedQuery) Query(fn func(rows pgx.Rows) error) {
+	q.fn = func(br pgx.BatchResults, res *BatchResult) error {
+		rows, _ := br.Query()
+		defer rows.Close()
+
+		if err := fn(rows); err != nil {
+			return err
+		}
+		rows.Close()
+
+		res.CommandTag = rows.CommandTag()
+		return rows.Err()
+	}
+}
+
+// QueryRow sets fn to be called with the row of the statement.
+func (q *ShardedQueuedQuery) QueryRow(fn func(row pgx.Row) error) {
+	q.fn = func(br pgx.BatchResults, res *BatchResult) error {
+		return fn(br.QueryRow())
+	}
+}
+
+// Exec sets fn to be called with the command tag of the statement.
+func (q *ShardedQueuedQuery) Exec(fn func(ct pgconn.CommandTag) error) {
+	q.fn = func(br pgx.BatchResults, res *BatchResult) error {
+		ct, err := br.Exec()
+		if err != nil {
+			return err
+		}
+
+		res.CommandTag = ct
+		return fn(ct)
+	}
+}
+
+// BatchResult is the result of a statement of a ShardedBatch.
+type BatchResult struct {
+	// ShardID is the ID of the shard the statement was routed to, empty if it
+	// could not be routed. During a topology transition, it is the shard
+	// reads are served from.
+	ShardID    string
+	CommandTag pgconn.CommandTag
+	// Err is the error of the statement or of its callback, if any.
+	Err error
+}
+
+// shardBatch is the part of a ShardedBatch sent to a shard.
+type shardBatch struct {
+	id      string
+	pool    *pgxpool.Pool
+	batch   pgx.Batch
+	entries []batchEntry
+}
+
+// batchEntry is a statement of a shardBatch.
+type batchEntry struct {
+	// index is the index of the statement in the ShardedBatch.
+	index int
+	// mirror is true if the statement is the copy of a write sent to the
+	// other shard of a moving key. Its error is kept in err until the
+	// batches of every shard are done.
+	mirror bool
+	err    error
+}
+
+// SendBatch sends the statements of b grouped by shard, as one pgx.Batch per
+// shard, to the shards concurrently. It returns the result of every statement
+// in the order the statements were queued, and a *MultiShardError with the
+// first error of every shard where a statement failed. Routing errors are
+// reported with an empty shard ID.
+//
+// During a topology transition, a statement whose key moves between shards is
+// queued on both, as returned by ShardsForWrite. Its callback is called with
+// the result of the shard reads are served from, and its result holds the
+// first error of either shard.
+//
+// The statements of a shard run in an implicit transaction, so an error rolls
+// back the statements of the batch on that shard and fails the following
+// ones. Statements of other shards are not affected.
+func (s *ShardManager) SendBatch(ctx context.Context, b *ShardedBatch) ([]BatchResult, error) {
+	results := make([]BatchResult, len(b.queries))
+	w := s.writeRouting()
+
+	var batches []*shardBatch
+	byPool := make(map[*pgxpool.Pool]*shardBatch)
+	for i, q := range b.queries {
+		targets, err := s.writeTargets(ctx, w, q.Key)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].ShardID = targets[0].id
+
+		for j, target := range targets {
+			sb, ok := byPool[target.pool]
+			if !ok {
+				sb = &shardBatch{id: target.id, pool: target.pool}
+				byPool[target.pool] = sb
+				batches = append(batches, sb)
+			}
+			sb.batch.Queue(q.SQL, q.Arguments...)
+			sb.entries = append(sb.entries, batchEntry{index: i, mirror: j > 0})
+		}
+	}
+
+	s.mu.RLock()
+	limit := s.maxParallelism
+	s.mu.RUnlock()
+	if limit <= 0 || limit > len(batches) {
+		limit = len(batches)
+	}
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, limit)
+	)
+	for _, sb := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			s.sendShardBatch(ctx, sb, b.queries, results)
+		}()
+	}
+	wg.Wait()
+
+	me := &MultiShardError{Shards: len(batches)}
+	reported := make(map[string]bool)
+	report := func(id string, err error) {
+		if err != nil && !reported[id] {
+			reported[id] = true
+			me.Errors = append(me.Errors, &ShardError{ShardID: id, Err: err})
+		}
+	}
+	for _, res := range results {
+		report(res.ShardID, res.Err)
+	}
+	for _, sb := range batches {
+		for _, e := range sb.entries {
+			if e.mirror && e.err != nil {
+				report(sb.id, e.err)
+				if results[e.index].Err == nil {
+					results[e.index].Err = e.err
+				}
+			}
+		}
+	}
+	if len(me.Errors) > 0 {
+		return results, me
+	}
+	return results, nil
+}
+
+// sendShardBatch sends sb and stores the result of each of its statements in
+// results, or in its entry for mirrored statements.
+func (s *ShardManager) sendShardBatch(ctx context.Context, sb *shardBatch, queries []*ShardedQueuedQuery, results []BatchResult) {
+	br := sb.pool.SendBatch(ctx, &sb.batch)
+
+	for k := range sb.entries {
+		e := &sb.entries[k]
+		if e.mirror {
+			_, e.err = br.Exec()
+			continue
+		}
+
+		res := &results[e.index]
+		if fn := queries[e.index].fn; fn != nil {
+			res.Err = fn(br, res)
+		} else {
+			res.CommandTag, res.Err = br.Exec()
+		}
+	}
+
+	err := br.Close()
+	failed := false
+	for k := range sb.entries {
+		e := &sb.entries[k]
+		errp := &e.err
+		if !e.mirror {
+			errp = &results[e.index].Err
+		}
+		if *errp == nil {
+			*errp = err
+		}
+		if *errp != nil && !failed {
+			failed = true
+			s.ObserveError(ctx, sb.id, *errp)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package pgxshard
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errEmptyCompositeKey = errors.New("empty composite key")
+
+// CompositeKey is a shard key made of several parts, such as a tenant ID and
+// a region, each of one of the Key types or a ShardKey. It is accepted by
+// every ShardManager method taking a key and by the shard strategies of this
+// package, except that RangeShardMap only accepts one-part composite keys,
+// as multi-part keys have no meaningful order.
+//
+// Parts are combined in order, so CompositeKey{1, "eu"} and
+// CompositeKey{"eu", 1} are different keys. A one-part CompositeKey routes
+// exactly like its part, so tables sharded by CompositeKey{tenantID} and by
+// tenantID alone are co-located.
+type CompositeKey []any
+
+// ShardHash returns the hash of the key, or 0 if a part is of an unsupported
+// type. ShardManager methods report unsupported parts as an error instead.
+func (c CompositeKey) ShardHash() uint64 {
+	h, _ := hashKey(c)
+	return h
+}
+
+// compositeHash returns the hash of c: the hash of its part if it has one,
+// and the hash of its encoding otherwise.
+func compositeHash(c CompositeKey) (uint64, error) {
+	if len(c) == 1 {
+		return hashKey(c[0])
+	}
+
+	b, err := compositeBytes(c)
+	if err != nil {
+		return 0, err
+	}
+	return hash64(b), nil
+}
+
+// Tags of the part types in the encoding of a CompositeKey. Integer types
+// share a tag, like strings and byte slices, so that parts holding the same
+// value encode identically whatever their type, as scalar keys do.
+const (
+	partInteger   byte = 'i'
+	partBytes     byte = 's'
+	partUUID      byte = 'u'
+	partShardKey  byte = 'h'
+	partComposite byte = 'c'
+)
+
+// compositeBytes returns the encoding of c: a one-part key is encoded as its
+// part, other keys as the sequence of their parts, each as a type tag and the
+// 4-byte big-endian length of the canonical encoding of the part followed by
+// that encoding.
+//
+// The encoding is part of the stability guarantee of the hashing strategies
+// and must not change within a major version of this module.
+func compositeBytes(c CompositeKey) ([]byte, error) {
+	switch len(c) {
+	case 0:
+		return nil, errEmptyCompositeKey
+	case 1:
+		return keyBytes(c[0])
+	}
+
+	var b []byte
+	for _, part := range c {
+		tag, err := partTag(part)
+		if err != nil {
+			return nil, err
+		}
+		p, err := keyBytes(part)
+		if err != nil {
+			return nil, err
+		}
+
+		b = append(b, tag)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(p)))
+		b = append(b, p...)
+	}
+	return b, nil
+}
+
+// partTag returns the type tag of a part of a CompositeKey.
+func partTag(part any) (byte, error) {
+	switch part.(type) {
+	case CompositeKey:
+		return partComposite, nil
+	case ShardKey:
+		return partShardKey, nil
+	}
+
+	n, ok := normalizeKey(part)
+	if !ok {
+		return 0, errKeyTypeNotSupported
+	}
+	switch n.(type) {
+	case int64, uint64:
+		return partInteger, nil
+	case [16]byte:
+		return partUUID, nil
+	}
+	return partBytes, nil
+}
+
+// compositeDirectoryKey returns the directory form of c: the directory form of
+// its part if it has one, and the quoted directory forms of its parts
+// separated by commas otherwise.
+func compositeDirectoryKey(c CompositeKey) (string, error) {
+	switch len(c) {
+	case 0:
+		return "", errEmptyCompositeKey
+	case 1:
+		return directoryKey(c[0])
+	}
+
+	parts := make([]string, len(c))
+	for i, part := range c {
+		k, err := directoryKey(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = strconv.Quote(k)
+	}
+	return strings.Join(parts, ","), nil
+}
@@ -0,0 +1,65 @@
+package pgxshard
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestCompositeBytes(t *testing.T) {
+	tests := []struct {
+		key  CompositeKey
+		want string
+	}{
+		{CompositeKey{42, "eu"}, "6900000008000000000000002a73000000026575"},
+		{CompositeKey{int8(42), []byte("eu")}, "6900000008000000000000002a73000000026575"},
+		{CompositeKey{"eu", 42}, "730000000265756900000008000000000000002a"},
+		{CompositeKey{[16]byte{1}, uint64(7)}, "75000000100100000000000000000000000000000069000000080000000000000007"},
+		{CompositeKey{CompositeKey{1, 2}, "x"}, "630000001a6900000008000000000000000169000000080000000000000002730000000178"},
+	}
+	for _, tt := range tests {
+		got, err := compositeBytes(tt.key)
+		if err != nil {
+			t.Fatalf("compositeBytes(%#v): %v", tt.key, err)
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("compositeBytes(%#v) = %x, want %s", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestCompositeKeyOnePart(t *testing.T) {
+	c := NewConsistentHash(0)
+	for _, v := range hashVectors {
+		key := CompositeKey{v.key}
+
+		if h, err := hashKey(key); err != nil || h != v.hash {
+			t.Errorf("hashKey(%#v) = %#x, %v, want %#x", key, h, err, v.hash)
+		}
+		if got, err := JumpHash(key, 16); err != nil || got != v.jump {
+			t.Errorf("JumpHash(%#v, 16) = %d, %v, want %d", key, got, err, v.jump)
+		}
+		if got, err := RendezvousHash(key, 16); err != nil || got != v.rendezvous {
+			t.Errorf("RendezvousHash(%#v, 16) = %d, %v, want %d", key, got, err, v.rendezvous)
+		}
+		if got, err := c.ShardIndex(key, 16); err != nil || got != v.ring {
+			t.Errorf("ConsistentHash.ShardIndex(%#v, 16) = %d, %v, want %d", key, got, err, v.ring)
+		}
+
+		want, err := defaultShardIndex(v.key, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := defaultShardIndex(key, 16); err != nil || got != want {
+			t.Errorf("defaultShardIndex(%#v, 16) = %d, %v, want %d", key, got, err, want)
+		}
+	}
+}
+
+func TestCompositeKeyInvalid(t *testing.T) {
+	if _, err := compositeBytes(CompositeKey{}); err != errEmptyCompositeKey {
+		t.Errorf("compositeBytes of an empty key error = %v, want %v", err, errEmptyCompositeKey)
+	}
+	if _, err := compositeBytes(CompositeKey{1, 1.5}); err != errKeyTypeNotSupported {
+		t.Errorf("compositeBytes with a float part error = %v, want %v", err, errKeyTypeNotSupported)
+	}
+}
@@ -0,0 +1,154 @@
+package pgxshard
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// copyBufferSize is the number of rows buffered per shard by CopyFrom.
+const copyBufferSize = 1024
+
+// CopyFrom copies the rows of src into tableName on their shards, routing
+// every row by the value of keyColumn. src is read once; rows are streamed to
+// one COPY per shard, all running concurrently. It returns the number of rows
+// copied per shard ID. During a topology transition, a row whose key moves
+// between shards is copied to both, as returned by ShardsForWrite.
+//
+// The COPY of every shard is atomic, but the load as a whole is not: if a
+// shard fails, the copies still running are cancelled, while the shards that
+// already finished keep their rows.
+func (s *ShardManager) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, keyColumn string, src pgx.CopyFromSource) (map[string]int64, error) {
+	keyIndex := -1
+	for i, name := range columnNames {
+		if name == keyColumn {
+			keyIndex = i
+		}
+	}
+	if keyIndex < 0 {
+		return nil, fmt.Errorf("key column %q is not one of the columns", keyColumn)
+	}
+
+	w := s.writeRouting()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		counts  = make(map[string]int64)
+		failed  error
+		streams = make(map[*pgxpool.Pool]chan []any)
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// The first failure cancels the other copies: keep it rather than the
+		// cancellations that follow.
+		if failed == nil {
+			failed = err
+		}
+		cancel()
+	}
+
+	stream := func(target writeTarget) chan []any {
+		if rows, ok := streams[target.pool]; ok {
+			return rows
+		}
+
+		rows := make(chan []any, copyBufferSize)
+		streams[target.pool] = rows
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			n, err := target.pool.CopyFrom(ctx, tableName, columnNames, &channelSource{ctx: ctx, rows: rows})
+			if err != nil {
+				s.ObserveError(ctx, target.id, err)
+				fail(&ShardError{ShardID: target.id, Err: err})
+				// Drain the stream so that the producer never blocks on it.
+				for range rows {
+				}
+				return
+			}
+
+			mu.Lock()
+			counts[target.id] = n
+			mu.Unlock()
+		}()
+
+		return rows
+	}
+
+	err := func() error {
+		for src.Next() {
+			values, err := src.Values()
+			if err != nil {
+				return err
+			}
+
+			targets, err := s.writeTargets(ctx, w, values[keyIndex])
+			if err != nil {
+				return err
+			}
+
+			// The row is only read by the copies, so they can share it.
+			row := append([]any(nil), values...)
+			for _, target := range targets {
+				select {
+				case stream(target) <- row:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		return src.Err()
+	}()
+	if err != nil {
+		fail(err)
+	}
+
+	for _, rows := range streams {
+		close(rows)
+	}
+	wg.Wait()
+
+	return counts, failed
+}
+
+// channelSource is a pgx.CopyFromSource reading rows from a channel until it
+// is closed. It fails if ctx is done first.
+type channelSource struct {
+	ctx    context.Context
+	rows   <-chan []any
+	values []any
+	err    error
+}
+
+// Next advances to the next row.
+func (c *channelSource) Next() bool {
+	select {
+	case values, ok := <-c.rows:
+		c.values = values
+		return ok
+	case <-c.ctx.Done():
+		c.err = c.ctx.Err()
+		return false
+	}
+}
+
+// Values returns the values of the current row.
+func (c *channelSource) Values() ([]any, error) {
+	return c.values, nil
+}
+
+// Err returns the error that stopped the source, if any.
+func (c *channelSource) Err() error {
+	return c.err
+}
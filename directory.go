@@ -0,0 +1,399 @@
+package pgxshard
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DirectoryStore resolves shard keys that are pinned to a specific shard.
+// Keys are passed in their directory form, see Directory.
+type DirectoryStore interface {
+	// LookupShard returns the shard index pinned for key, and false if the
+	// key is not in the directory.
+	LookupShard(ctx context.Context, key string) (int, bool, error)
+}
+
+// DefaultDirectoryCacheTTL is how long a Directory caches lookups unless
+// SetCacheTTL is called.
+const DefaultDirectoryCacheTTL = 30 * time.Second
+
+// Directory is a shard index strategy resolving keys through a DirectoryStore,
+// so individual keys such as hot tenants can be moved between shards by
+// updating the directory. Keys missing from the directory are routed by a
+// fallback strategy. Lookups are kept in an LRU cache for
+// DefaultDirectoryCacheTTL by default: keys re-pinned through the store of
+// the Directory take effect at once, keys re-pinned by other processes once
+// the cached lookup expires.
+//
+// Keys are stored in the directory in their decimal form for integers, as is
+// for strings and byte slices, and in the canonical UUID form for [16]byte.
+// Other ShardKey keys are stored as the decimal form of their ShardHash.
+// Composite keys are stored as the quoted forms of their parts separated by
+// commas.
+//
+// Its ShardIndexContext method can be installed with
+// ShardManager.SetShardIndexContextFunc or WithShardIndexContextFunc.
+type Directory struct {
+	store    DirectoryStore
+	fallback ShardIndexFunc
+	cache    *lruCache
+	ttl      atomic.Int64
+}
+
+// directoryWatcher is implemented by the stores of this package to notify
+// the directories on top of them of the keys they pin or unpin.
+type directoryWatcher interface {
+	watch(f func(key string))
+}
+
+// storeWatchers are the functions notified of the keys changed in a store.
+type storeWatchers struct {
+	mu sync.Mutex
+	fs []func(key string)
+}
+
+func (w *storeWatchers) watch(f func(key string)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.fs = append(w.fs, f)
+}
+
+func (w *storeWatchers) notify(key string) {
+	w.mu.Lock()
+	fs := w.fs
+	w.mu.Unlock()
+
+	for _, f := range fs {
+		f(key)
+	}
+}
+
+// NewDirectory creates a Directory on top of store, routing unknown keys with
+// fallback, or the default shard index function if fallback is nil. Up to
+// cacheSize lookups are cached; a non-positive cacheSize disables the cache.
+func NewDirectory(store DirectoryStore, fallback ShardIndexFunc, cacheSize int) *Directory {
+	if fallback == nil {
+		fallback = defaultShardIndexFunc
+	}
+
+	d := &Directory{
+		store:    store,
+		fallback: fallback,
+		cache:    newLRUCache(cacheSize),
+	}
+	d.ttl.Store(int64(DefaultDirectoryCacheTTL))
+	if w, ok := store.(directoryWatcher); ok {
+		w.watch(d.cache.remove)
+	}
+
+	return d
+}
+
+// SetCacheTTL sets how long a cached lookup stays valid. A zero ttl keeps
+// entries until they are evicted or invalidated.
+func (d *Directory) SetCacheTTL(ttl time.Duration) {
+	d.ttl.Store(int64(ttl))
+}
+
+// Invalidate removes the cached lookup of key, so that the next lookup reads
+// the directory store again.
+func (d *Directory) Invalidate(key any) error {
+	k, err := directoryKey(key)
+	if err != nil {
+		return err
+	}
+
+	d.cache.remove(k)
+	return nil
+}
+
+// ShardIndexContext returns the shard pinned for key in the directory, or the
+// shard chosen by the fallback strategy if the key is not pinned.
+func (d *Directory) ShardIndexContext(ctx context.Context, key any, numShards int) (int, error) {
+	k, err := directoryKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	e, version, ok := d.cache.get(k)
+	if !ok {
+		shard, found, err := d.store.LookupShard(ctx, k)
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up shard key %q: %w", k, err)
+		}
+
+		e = directoryEntry{shard: shard, found: found}
+		if ttl := time.Duration(d.ttl.Load()); ttl > 0 {
+			e.expires = time.Now().Add(ttl)
+		}
+		d.cache.add(k, e, version)
+	}
+
+	if !e.found {
+		return d.fallback(key, numShards)
+	}
+	return e.shard, nil
+}
+
+// directoryKey returns the directory form of key.
+func directoryKey(key any) (string, error) {
+	switch v := key.(type) {
+	case CompositeKey:
+		return compositeDirectoryKey(v)
+	case int:
+		return strconv.Itoa(v), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case [16]byte:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", v[0:4], v[4:6], v[6:8], v[8:10], v[10:16]), nil
+	}
+
+	if n, ok := normalizeKey(key); ok {
+		return directoryKey(n)
+	}
+	if k, ok := key.(ShardKey); ok {
+		return strconv.FormatUint(k.ShardHash(), 10), nil
+	}
+	return "", errKeyTypeNotSupported
+}
+
+// MapDirectoryStore is an in-memory DirectoryStore.
+type MapDirectoryStore struct {
+	storeWatchers
+
+	mu      sync.RWMutex
+	entries map[string]int
+}
+
+// NewMapDirectoryStore creates a MapDirectoryStore holding a copy of entries,
+// keyed by directory form.
+func NewMapDirectoryStore(entries map[string]int) *MapDirectoryStore {
+	m := make(map[string]int, len(entries))
+	for k, v := range entries {
+		m[k] = v
+	}
+
+	return &MapDirectoryStore{entries: m}
+}
+
+// LookupShard returns the shard pinned for key.
+func (m *MapDirectoryStore) LookupShard(ctx context.Context, key string) (int, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	shard, ok := m.entries[key]
+	return shard, ok, nil
+}
+
+// Set pins key to shard.
+func (m *MapDirectoryStore) Set(key any, shard int) error {
+	k, err := directoryKey(key)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.entries[k] = shard
+	m.mu.Unlock()
+
+	m.notify(k)
+	return nil
+}
+
+// Delete unpins key.
+func (m *MapDirectoryStore) Delete(key any) error {
+	k, err := directoryKey(key)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.entries, k)
+	m.mu.Unlock()
+
+	m.notify(k)
+	return nil
+}
+
+// PgDirectoryStore is a DirectoryStore backed by a metadata table on a
+// catalog database. The table has a text shard_key primary key column and an
+// integer shard column, and can be created with CreateTable.
+type PgDirectoryStore struct {
+	storeWatchers
+
+	pool  *pgxpool.Pool
+	table string
+}
+
+// NewPgDirectoryStore creates a PgDirectoryStore reading the given table,
+// optionally schema-qualified, on the catalog pool.
+func NewPgDirectoryStore(pool *pgxpool.Pool, table string) *PgDirectoryStore {
+	return &PgDirectoryStore{
+		pool:  pool,
+		table: sanitizeTable(table),
+	}
+}
+
+// CreateTable creates the directory table if it does not exist.
+func (p *PgDirectoryStore) CreateTable(ctx context.Context) error {
+	_, err := p.pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+p.table+` (
+		shard_key text PRIMARY KEY,
+		shard integer NOT NULL
+	)`)
+	return err
+}
+
+// LookupShard returns the shard pinned for key.
+func (p *PgDirectoryStore) LookupShard(ctx context.Context, key string) (int, bool, error) {
+	var shard int
+	err := p.pool.QueryRow(ctx, `SELECT shard FROM `+p.table+` WHERE shard_key = $1`, key).Scan(&shard)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return shard, true, nil
+}
+
+// Set pins key to shard.
+func (p *PgDirectoryStore) Set(ctx context.Context, key any, shard int) error {
+	k, err := directoryKey(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.pool.Exec(ctx, `INSERT INTO `+p.table+` (shard_key, shard) VALUES ($1, $2)
+		ON CONFLICT (shard_key) DO UPDATE SET shard = EXCLUDED.shard`, k, shard)
+	if err != nil {
+		return err
+	}
+
+	p.notify(k)
+	return nil
+}
+
+// Delete unpins key.
+func (p *PgDirectoryStore) Delete(ctx context.Context, key any) error {
+	k, err := directoryKey(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.pool.Exec(ctx, `DELETE FROM `+p.table+` WHERE shard_key = $1`, k)
+	if err != nil {
+		return err
+	}
+
+	p.notify(k)
+	return nil
+}
+
+type directoryEntry struct {
+	shard   int
+	found   bool
+	expires time.Time
+}
+
+type lruItem struct {
+	key   string
+	entry directoryEntry
+}
+
+// lruCache is a fixed-size, concurrency-safe LRU cache of directory lookups.
+// Its version changes whenever a key is removed, so that a lookup racing with
+// the invalidation of its key is not cached.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	items   map[string]*list.Element
+	version uint64
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the entry of key and, if it is missing, the version of the
+// cache to add it with.
+func (c *lruCache) get(key string) (directoryEntry, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return directoryEntry{}, c.version, false
+	}
+
+	item := el.Value.(*lruItem)
+	if !item.entry.expires.IsZero() && time.Now().After(item.entry.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return directoryEntry{}, c.version, false
+	}
+
+	c.ll.MoveToFront(el)
+	return item.entry, c.version, true
+}
+
+// add caches entry for key unless a key was removed since version was read
+// from get.
+func (c *lruCache) add(key string, entry directoryEntry, version uint64) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.version != version {
+		return
+	}
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*lruItem).entry = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruItem{key: key, entry: entry})
+	if c.ll.Len() > c.size {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*lruItem).key)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.version++
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
@@ -0,0 +1,58 @@
+package pgxshard
+
+import (
+	"context"
+	"testing"
+)
+
+// repinningStore re-pins the key it looks up once, after reading its old
+// shard, like a Set racing with a cache miss.
+type repinningStore struct {
+	*MapDirectoryStore
+	repinned bool
+}
+
+func (s *repinningStore) LookupShard(ctx context.Context, key string) (int, bool, error) {
+	shard, ok, err := s.MapDirectoryStore.LookupShard(ctx, key)
+	if !s.repinned {
+		s.repinned = true
+		s.Set(key, 3)
+	}
+	return shard, ok, err
+}
+
+func TestDirectoryRepinDuringLookup(t *testing.T) {
+	ctx := context.Background()
+	store := &repinningStore{MapDirectoryStore: NewMapDirectoryStore(map[string]int{"tenant-1": 1})}
+	d := NewDirectory(store, nil, 16)
+
+	// The first lookup raced with the re-pin, so it must not be cached.
+	if shard, err := d.ShardIndexContext(ctx, "tenant-1", 4); err != nil || shard != 1 {
+		t.Fatalf("first lookup = %d, %v, want 1", shard, err)
+	}
+	if shard, err := d.ShardIndexContext(ctx, "tenant-1", 4); err != nil || shard != 3 {
+		t.Errorf("lookup after the re-pin = %d, %v, want 3", shard, err)
+	}
+}
+
+func TestDirectoryInvalidatesLocalPins(t *testing.T) {
+	ctx := context.Background()
+	store := NewMapDirectoryStore(nil)
+	d := NewDirectory(store, func(key any, numShards int) (int, error) { return 0, nil }, 16)
+
+	if shard, _ := d.ShardIndexContext(ctx, int64(7), 4); shard != 0 {
+		t.Fatalf("unpinned key routed to %d, want the fallback shard 0", shard)
+	}
+	if err := store.Set(int64(7), 2); err != nil {
+		t.Fatal(err)
+	}
+	if shard, _ := d.ShardIndexContext(ctx, int64(7), 4); shard != 2 {
+		t.Errorf("pinned key routed to %d, want 2", shard)
+	}
+	if err := store.Delete(int64(7)); err != nil {
+		t.Fatal(err)
+	}
+	if shard, _ := d.ShardIndexContext(ctx, int64(7), 4); shard != 0 {
+		t.Errorf("unpinned key routed to %d, want the fallback shard 0", shard)
+	}
+}
@@ -0,0 +1,318 @@
+package pgxshard
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// coordinatorTable is the table of the coordinator log, holding the
+// participants and the decision of every distributed transaction.
+const coordinatorTable = "pgxshard_distributed_transactions"
+
+// gidPrefix starts the global transaction IDs of prepared transactions. The
+// full ID is "pgxshard:<transaction ID>:<number of participants>:<shard ID>".
+const gidPrefix = "pgxshard:"
+
+// Decisions recorded in the coordinator log.
+const (
+	decisionPending = "pending"
+	decisionCommit  = "commit"
+	decisionAbort   = "abort"
+)
+
+// ErrNoCoordinator is returned by BeginDistributed when no coordinator pool is
+// configured.
+var ErrNoCoordinator = errors.New("no coordinator pool configured")
+
+// ErrRecoveredAbort is returned by DistributedTx.Commit when RecoverPrepared
+// aborted the transaction before its commit decision was recorded.
+var ErrRecoveredAbort = errors.New("distributed transaction aborted by recovery")
+
+// DistributedTx is a transaction spanning several shards, committed
+// atomically with two-phase commit. The shard transactions are obtained with
+// Tx or TxByShardID and must only be finished through the DistributedTx.
+//
+// Shards must allow prepared transactions (max_prepared_transactions > 0).
+type DistributedTx struct {
+	s            *ShardManager
+	id           string
+	coordinator  *pgxpool.Pool
+	participants []*participant
+	byID         map[string]*participant
+	done         bool
+}
+
+// participant is the transaction of a shard in a DistributedTx.
+type participant struct {
+	shardID  string
+	conn     *pgxpool.Conn
+	tx       pgx.Tx
+	prepared bool
+}
+
+// gid returns the global transaction ID of the participant's prepared
+// transaction.
+func (d *DistributedTx) gid(p *participant) string {
+	return gidPrefix + d.id + ":" + strconv.Itoa(len(d.participants)) + ":" + p.shardID
+}
+
+// SetCoordinatorPool sets the pool holding the coordinator log of distributed
+// transactions. The log table can be created with CreateCoordinatorTable.
+func (s *ShardManager) SetCoordinatorPool(ctx context.Context, pool *pgxpool.Pool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coordinator = pool
+}
+
+// CreateCoordinatorTable creates the coordinator log table on the coordinator
+// pool if it does not exist.
+func (s *ShardManager) CreateCoordinatorTable(ctx context.Context) error {
+	coordinator, err := s.coordinatorPool()
+	if err != nil {
+		return err
+	}
+
+	_, err = coordinator.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+coordinatorTable+` (
+		id text PRIMARY KEY,
+		participants text[] NOT NULL,
+		decision text NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	return err
+}
+
+// coordinatorPool returns the coordinator pool.
+func (s *ShardManager) coordinatorPool() (*pgxpool.Pool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.coordinator == nil {
+		return nil, ErrNoCoordinator
+	}
+	return s.coordinator, nil
+}
+
+// BeginDistributed begins a distributed transaction on the shards of the
+// provided keys, opening one transaction per distinct shard. During a
+// topology transition, it returns an error matching ErrTransitionInProgress
+// if one of the keys moves between shards.
+func (s *ShardManager) BeginDistributed(ctx context.Context, keys ...any) (*DistributedTx, error) {
+	coordinator, err := s.coordinatorPool()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+
+	id, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DistributedTx{s: s, id: id, coordinator: coordinator, byID: make(map[string]*participant)}
+	for _, key := range keys {
+		if _, err := d.participant(ctx, key); err != nil {
+			d.Rollback(ctx)
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// participant returns the participant of the shard for key, beginning a
+// transaction on the shard if it is not part of the transaction yet.
+func (d *DistributedTx) participant(ctx context.Context, key any) (*participant, error) {
+	t, index, err := d.s.locateWrite(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	id := t.ids[index]
+	if p, ok := d.byID[id]; ok {
+		return p, nil
+	}
+
+	conn, err := t.pools[index].Acquire(ctx)
+	if err != nil {
+		return nil, &ShardError{ShardID: id, Err: err}
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		conn.Release()
+		return nil, &ShardError{ShardID: id, Err: err}
+	}
+
+	p := &participant{shardID: id, conn: conn, tx: tx}
+	d.participants = append(d.participants, p)
+	d.byID[id] = p
+	return p, nil
+}
+
+// newTransactionID returns a random transaction ID.
+func newTransactionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ID returns the ID of the distributed transaction.
+func (d *DistributedTx) ID() string {
+	return d.id
+}
+
+// Tx returns the transaction on the shard for key. The key's shard must be one
+// of the shards of the keys passed to BeginDistributed.
+func (d *DistributedTx) Tx(ctx context.Context, key any) (pgx.Tx, error) {
+	id, err := d.s.ShardID(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return d.TxByShardID(id)
+}
+
+// TxByShardID returns the transaction on the shard with the provided ID.
+func (d *DistributedTx) TxByShardID(id string) (pgx.Tx, error) {
+	p, ok := d.byID[id]
+	if !ok {
+		return nil, fmt.Errorf("shard %s is not part of distributed transaction %s", id, d.id)
+	}
+	return p.tx, nil
+}
+
+// Commit commits the distributed transaction with two-phase commit. The
+// participants are recorded in the coordinator log and every shard
+// transaction is prepared; if all shards prepared, the commit decision is
+// recorded and the prepared transactions are committed, otherwise they are
+// rolled back.
+//
+// Once the commit decision is recorded the transaction is committed, even if
+// a shard fails to commit its prepared transaction; such failures are returned
+// as a *MultiShardError and the prepared transactions are left for
+// RecoverPrepared. If recording the decision fails, its outcome is unknown and
+// the prepared transactions are also left for RecoverPrepared. If
+// RecoverPrepared aborted the transaction first, Commit rolls it back and
+// returns an error matching ErrRecoveredAbort.
+func (d *DistributedTx) Commit(ctx context.Context) error {
+	if d.done {
+		return pgx.ErrTxClosed
+	}
+	d.done = true
+	defer d.release()
+
+	ids := make([]string, len(d.participants))
+	for i, p := range d.participants {
+		ids[i] = p.shardID
+	}
+	if _, err := d.coordinator.Exec(ctx, `INSERT INTO `+coordinatorTable+` (id, participants, decision)
+		VALUES ($1, $2, $3)`, d.id, ids, decisionPending); err != nil {
+		d.abort(ctx)
+		return fmt.Errorf("failed to log distributed transaction %s: %w", d.id, err)
+	}
+
+	for _, p := range d.participants {
+		if _, err := p.tx.Exec(ctx, "PREPARE TRANSACTION "+quoteLiteral(d.gid(p))); err != nil {
+			d.abort(ctx)
+			return fmt.Errorf("failed to prepare distributed transaction %s: %w", d.id, &ShardError{ShardID: p.shardID, Err: err})
+		}
+		p.prepared = true
+	}
+
+	decided, err := d.decide(ctx, decisionCommit)
+	if err != nil {
+		// The decision may have been recorded even though the reply was lost:
+		// the prepared transactions are left in doubt for RecoverPrepared.
+		return fmt.Errorf("commit of distributed transaction %s is in doubt: %w", d.id, err)
+	}
+	if !decided {
+		d.abort(ctx)
+		return fmt.Errorf("distributed transaction %s: %w", d.id, ErrRecoveredAbort)
+	}
+
+	me := &MultiShardError{Shards: len(d.participants)}
+	for _, p := range d.participants {
+		if _, err := p.conn.Exec(ctx, "COMMIT PREPARED "+quoteLiteral(d.gid(p))); err != nil {
+			me.Errors = append(me.Errors, &ShardError{ShardID: p.shardID, Err: err})
+		}
+	}
+	if len(me.Errors) > 0 {
+		return fmt.Errorf("distributed transaction %s is committed but not finalized: %w", d.id, me)
+	}
+
+	// Every participant committed: the log entry is no longer needed.
+	d.coordinator.Exec(ctx, `DELETE FROM `+coordinatorTable+` WHERE id = $1`, d.id)
+	return nil
+}
+
+// Rollback rolls back the distributed transaction. It is a no-op if the
+// transaction is already committed or rolled back.
+func (d *DistributedTx) Rollback(ctx context.Context) error {
+	if d.done {
+		return nil
+	}
+	d.done = true
+	defer d.release()
+
+	for _, p := range d.participants {
+		p.tx.Rollback(ctx)
+	}
+	return nil
+}
+
+// abort rolls back the participants that are not prepared, records the abort
+// decision and, once it is recorded, rolls back the prepared participants.
+// Prepared transactions are left for RecoverPrepared if the decision cannot be
+// recorded or they fail to roll back.
+func (d *DistributedTx) abort(ctx context.Context) {
+	for _, p := range d.participants {
+		if !p.prepared {
+			p.tx.Rollback(ctx)
+		}
+	}
+
+	// Only aborts are recorded besides the commit decision of Commit, so a
+	// decision recorded by someone else is an abort as well.
+	if _, err := d.decide(ctx, decisionAbort); err != nil {
+		return
+	}
+	for _, p := range d.participants {
+		if p.prepared {
+			p.conn.Exec(ctx, "ROLLBACK PREPARED "+quoteLiteral(d.gid(p)))
+		}
+	}
+}
+
+// decide records decision in the coordinator log if no decision is recorded
+// yet, and reports whether it did. A decision is already recorded if
+// RecoverPrepared aborted the transaction.
+func (d *DistributedTx) decide(ctx context.Context, decision string) (bool, error) {
+	tag, err := d.coordinator.Exec(ctx, `UPDATE `+coordinatorTable+` SET decision = $2, updated_at = now()
+		WHERE id = $1 AND decision = $3`, d.id, decision, decisionPending)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// release returns the connections of every participant to their pool.
+func (d *DistributedTx) release() {
+	for _, p := range d.participants {
+		p.conn.Release()
+	}
+}
+
+// quoteLiteral quotes s as an SQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
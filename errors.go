@@ -0,0 +1,120 @@
+package pgxshard
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ShardError is the error of an operation on a single shard.
+type ShardError struct {
+	ShardID string
+	Err     error
+}
+
+// Error returns the error message prefixed with the shard ID.
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("shard %s: %v", e.ShardID, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ShardError) Unwrap() error {
+	return e.Err
+}
+
+// MultiShardError lists the shards that failed during an operation run on
+// several shards. It unwraps to its ShardErrors, so errors.Is and errors.As
+// match the error of any failed shard.
+type MultiShardError struct {
+	// Errors are the errors of the failed shards, in shard order.
+	Errors []*ShardError
+	// Shards is the number of shards the operation ran on.
+	Shards int
+}
+
+// Error returns a message listing the errors of every failed shard.
+func (e *MultiShardError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d of %d shards failed: %s", len(e.Errors), e.Shards, strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of the failed shards.
+func (e *MultiShardError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// ShardIDs returns the IDs of the failed shards.
+func (e *MultiShardError) ShardIDs() []string {
+	ids := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		ids[i] = err.ShardID
+	}
+	return ids
+}
+
+type failureMode int
+
+const (
+	failFast failureMode = iota
+	bestEffort
+	quorum
+)
+
+// FailurePolicy decides whether an operation run on all shards, such as Ping
+// or QueryAll, succeeds when some shards fail. The zero value is FailFast.
+type FailurePolicy struct {
+	mode   failureMode
+	quorum int
+}
+
+// FailFast returns a policy failing the operation as soon as one shard fails,
+// canceling the work on the other shards.
+func FailFast() FailurePolicy {
+	return FailurePolicy{mode: failFast}
+}
+
+// BestEffort returns a policy running the operation on every shard and
+// failing it only if all shards fail.
+func BestEffort() FailurePolicy {
+	return FailurePolicy{mode: bestEffort}
+}
+
+// Quorum returns a policy failing the operation if fewer than n shards
+// succeed. The work on the other shards is canceled as soon as the quorum can
+// no longer be reached. A quorum of less than one shard is raised to one, and
+// an operation on fewer than n shards fails without running.
+func Quorum(n int) FailurePolicy {
+	return FailurePolicy{mode: quorum, quorum: max(n, 1)}
+}
+
+// required returns the number of shards out of n that must succeed. It fails
+// if the quorum of the policy exceeds n.
+func (p FailurePolicy) required(n int) (int, error) {
+	switch p.mode {
+	case bestEffort:
+		return min(1, n), nil
+	case quorum:
+		if p.quorum > n {
+			return 0, fmt.Errorf("quorum of %d shards cannot be reached with %d shards", p.quorum, n)
+		}
+		return p.quorum, nil
+	}
+	return n, nil
+}
+
+// String returns a description of the policy.
+func (p FailurePolicy) String() string {
+	switch p.mode {
+	case bestEffort:
+		return "best-effort"
+	case quorum:
+		return fmt.Sprintf("quorum(%d)", p.quorum)
+	}
+	return "fail-fast"
+}
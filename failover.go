@@ -0,0 +1,236 @@
+package pgxshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// FailoverEvent describes a shard reconnecting to a new primary.
+type FailoverEvent struct {
+	ShardID string
+	OldHost string
+	NewHost string
+}
+
+// openPrimary opens the pool of the primary of shard, resolving it among the
+// shard's hosts if it has any. It returns the resolved host.
+func openPrimary(ctx context.Context, shard ShardConfig) (*pgxpool.Pool, string, error) {
+	if len(shard.Hosts) == 0 {
+		db, err := pgxpool.New(ctx, shard.ConnString)
+		return db, "", err
+	}
+
+	cfg, host, err := resolvePrimary(ctx, shard)
+	if err != nil {
+		return nil, "", err
+	}
+
+	db, err := pgxpool.NewWithConfig(ctx, cfg)
+	return db, host, err
+}
+
+// resolvePrimary returns the pool configuration of the first host of shard
+// that is not in recovery.
+func resolvePrimary(ctx context.Context, shard ShardConfig) (*pgxpool.Config, string, error) {
+	base, err := pgxpool.ParseConfig(shard.ConnString)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var errs []error
+	for _, host := range shard.Hosts {
+		cfg := base.Copy()
+		if err := setHost(cfg.ConnConfig, host); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		inRecovery, err := probeRecovery(ctx, cfg.ConnConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", host, err))
+			continue
+		}
+		if !inRecovery {
+			return cfg, host, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("no primary found among %d hosts: %w", len(shard.Hosts), errors.Join(errs...))
+}
+
+// setHost points cfg to host, given as "host" or "host:port".
+func setHost(cfg *pgx.ConnConfig, host string) error {
+	h, p, err := net.SplitHostPort(host)
+	if err != nil {
+		cfg.Host = host
+	} else {
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port in host %q", host)
+		}
+		cfg.Host = h
+		cfg.Port = uint16(port)
+	}
+	cfg.Fallbacks = nil
+
+	return nil
+}
+
+// probeRecovery connects to cfg and reports whether the server is in recovery.
+func probeRecovery(ctx context.Context, cfg *pgx.ConnConfig) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultHealthTimeout)
+	defer cancel()
+
+	conn, err := pgx.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(ctx)
+
+	var inRecovery bool
+	err = conn.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery)
+	return inRecovery, err
+}
+
+// isFailoverError reports whether err suggests the primary of a shard was
+// demoted or shut down.
+func isFailoverError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	switch pgErr.Code {
+	case "25006", // read_only_sql_transaction
+		"57P01", // admin_shutdown
+		"57P02", // crash_shutdown
+		"57P03": // cannot_connect_now
+		return true
+	}
+	return false
+}
+
+// CheckPrimary verifies that the primary of the shard with the provided ID is
+// still writable. If it is in recovery or unreachable, the primary is resolved
+// again among the shard's hosts and, if it moved, the shard's pool is rebuilt
+// against the new primary and the old pool is closed in the background once
+// its connections are released. It returns true if the shard moved to a new
+// primary. Shards without hosts are not checked.
+//
+// The health checker calls CheckPrimary for shards reported in recovery or
+// failing their health check.
+func (s *ShardManager) CheckPrimary(ctx context.Context, id string) (bool, error) {
+	moved, event, old, err := s.switchPrimary(ctx, id)
+	if !moved {
+		return false, err
+	}
+
+	s.mu.RLock()
+	handler := s.failoverHandler
+	s.mu.RUnlock()
+
+	if handler != nil {
+		handler(event)
+	}
+	go closePools([]*pgxpool.Pool{old})
+
+	return true, nil
+}
+
+// switchPrimary implements CheckPrimary under topoMu. If the shard moved to a
+// new primary, it returns the failover event and the pool of the old primary.
+func (s *ShardManager) switchPrimary(ctx context.Context, id string) (bool, FailoverEvent, *pgxpool.Pool, error) {
+	s.topoMu.Lock()
+	defer s.topoMu.Unlock()
+
+	t := s.topology()
+	index, ok := t.indexes[id]
+	if !ok {
+		return false, FailoverEvent{}, nil, fmt.Errorf("shard %q not found", id)
+	}
+	shard, old, oldHost := t.configs[index], t.pools[index], t.primaries[index]
+	if len(shard.Hosts) == 0 {
+		return false, FailoverEvent{}, nil, nil
+	}
+
+	if inRecovery, err := poolInRecovery(ctx, old); err == nil && !inRecovery {
+		return false, FailoverEvent{}, nil, nil
+	}
+
+	cfg, host, err := resolvePrimary(ctx, shard)
+	if err != nil {
+		return false, FailoverEvent{}, nil, fmt.Errorf("failed to resolve primary of shard %s: %w", id, err)
+	}
+	if host == oldHost {
+		return false, FailoverEvent{}, nil, nil
+	}
+
+	db, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return false, FailoverEvent{}, nil, fmt.Errorf("failed to connect to shard %s: %w", id, err)
+	}
+
+	s.mu.Lock()
+	s.topo = s.topo.withPrimary(old, db, host)
+	if s.next != nil {
+		s.next = s.next.withPrimary(old, db, host)
+	}
+	s.mu.Unlock()
+
+	return true, FailoverEvent{ShardID: id, OldHost: oldHost, NewHost: host}, old, nil
+}
+
+// ObserveError lets the ShardManager inspect an error returned by the primary
+// of the shard with the provided ID. If the error suggests the primary was
+// demoted or shut down, CheckPrimary is run in the background. It returns true
+// if a check was started.
+func (s *ShardManager) ObserveError(ctx context.Context, id string, err error) bool {
+	if !isFailoverError(err) {
+		return false
+	}
+	if _, running := s.primaryChecks.LoadOrStore(id, true); running {
+		return false
+	}
+
+	go func() {
+		defer s.primaryChecks.Delete(id)
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 3*DefaultHealthTimeout)
+		defer cancel()
+		s.CheckPrimary(ctx, id)
+	}()
+
+	return true
+}
+
+// poolInRecovery reports whether the server behind pool is in recovery.
+func poolInRecovery(ctx context.Context, pool *pgxpool.Pool) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultHealthTimeout)
+	defer cancel()
+
+	var inRecovery bool
+	err := pool.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery)
+	return inRecovery, err
+}
+
+// withPrimary returns a copy of t in which the primary pool old is replaced by
+// db, connected to host.
+func (t *topology) withPrimary(old, db *pgxpool.Pool, host string) *topology {
+	c := *t
+	c.pools = append([]*pgxpool.Pool(nil), t.pools...)
+	c.primaries = append([]string(nil), t.primaries...)
+	for i, pool := range c.pools {
+		if pool == old {
+			c.pools[i] = db
+			c.primaries[i] = host
+		}
+	}
+	return &c
+}
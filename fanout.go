@@ -0,0 +1,395 @@
+package pgxshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var errNoCurrentRow = errors.New("no current row")
+
+// forEachShard calls fn concurrently for every shard of t, running at most
+// the configured maximum parallelism at a time, and applies the configured
+// failure policy. The context passed to fn is canceled as soon as the policy
+// can no longer be satisfied.
+//
+// It returns the errors of the failed shards, if any, and also returns them as
+// the error if the policy is not satisfied. It fails without calling fn if t
+// has fewer shards than the quorum of the policy.
+func (s *ShardManager) forEachShard(ctx context.Context, t *topology, fn func(ctx context.Context, index int) error) (*MultiShardError, error) {
+	s.mu.RLock()
+	limit := s.maxParallelism
+	s.mu.RUnlock()
+
+	return s.forEachShardLimit(ctx, t, limit, fn)
+}
+
+// forEachShardLimit is forEachShard running at most limit shards at a time,
+// or every shard at once if limit is not positive.
+func (s *ShardManager) forEachShardLimit(ctx context.Context, t *topology, limit int, fn func(ctx context.Context, index int) error) (*MultiShardError, error) {
+	s.mu.RLock()
+	policy := s.failurePolicy
+	s.mu.RUnlock()
+	if limit <= 0 || limit > len(t.pools) {
+		limit = len(t.pools)
+	}
+	required, err := policy.required(len(t.pools))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		errs    = make([]error, len(t.pools))
+		failed  int
+		stopped bool
+		sem     = make(chan struct{}, limit)
+	)
+	fail := func(i int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		failed++
+		if !stopped || !errors.Is(err, context.Canceled) {
+			errs[i] = err
+		}
+		if !stopped && len(t.pools)-failed < required {
+			stopped = true
+			cancel()
+		}
+	}
+
+	for i := range t.pools {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			fail(i, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := fn(ctx, i); err != nil {
+				fail(i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	me := &MultiShardError{Shards: len(t.pools)}
+	for i, err := range errs {
+		if err != nil {
+			me.Errors = append(me.Errors, &ShardError{ShardID: t.ids[i], Err: err})
+		}
+	}
+	if len(me.Errors) == 0 && failed == 0 {
+		return nil, nil
+	}
+	if len(t.pools)-failed < required {
+		return me, me
+	}
+	return me, nil
+}
+
+// QueryAll executes sql on every shard concurrently, querying at most the
+// configured maximum parallelism of shards at a time, and returns the rows of
+// all shards merged in arrival order. The shard a row came from is reported by
+// ShardRows.ShardID.
+//
+// Shard failures are handled according to the configured failure policy. If
+// the policy is not satisfied, ShardRows.Err returns a *MultiShardError once
+// the rows are exhausted; otherwise the errors of the failed shards are
+// reported by ShardRows.ShardErrors. Rows received from a shard before it
+// failed are not withdrawn.
+func (s *ShardManager) QueryAll(ctx context.Context, sql string, args ...any) (*ShardRows, error) {
+	t := s.readTopology()
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := newShardRows(t, cancel)
+
+	go func() {
+		shardErrs, err := s.forEachShard(ctx, t, func(ctx context.Context, i int) error {
+			return produce(ctx, r.rows, i, func(ctx context.Context) (shardRowSource, error) {
+				return t.pools[i].Query(ctx, sql, args...)
+			})
+		})
+		r.finish(shardErrs, err)
+	}()
+
+	return r, nil
+}
+
+// shardRowSource is the subset of pgx.Rows read by ShardRows producers.
+type shardRowSource interface {
+	Next() bool
+	Err() error
+	Close()
+	FieldDescriptions() []pgconn.FieldDescription
+	RawValues() [][]byte
+}
+
+type shardRow struct {
+	shard  int
+	fields []pgconn.FieldDescription
+	values [][]byte
+}
+
+// ShardRows is the result of a query run on several shards. It implements
+// pgx.Rows, so it can be used with pgx.CollectRows and the pgx.RowTo
+// functions, and additionally reports the shard of the current row.
+//
+// Values are decoded with the default pgx type map, so types registered on
+// the shard connections are not known to ShardRows.
+type ShardRows struct {
+	ids     []string
+	rows    chan shardRow
+	cancel  context.CancelFunc
+	err     error
+	partial *MultiShardError
+	typeMap *pgtype.Map
+	cur     shardRow
+	count   int64
+	closed  bool
+	// abandoned is set when Close is called before the rows are exhausted,
+	// so that the cancellations it causes are not reported as failures.
+	abandoned atomic.Bool
+}
+
+func newShardRows(t *topology, cancel context.CancelFunc) *ShardRows {
+	return &ShardRows{
+		ids:     t.ids,
+		rows:    make(chan shardRow, 64),
+		cancel:  cancel,
+		typeMap: pgtype.NewMap(),
+		cur:     shardRow{shard: -1},
+	}
+}
+
+// produce runs query and sends its rows to out, tagged with shard i.
+func produce(ctx context.Context, out chan<- shardRow, i int, query func(ctx context.Context) (shardRowSource, error)) error {
+	rows, err := query(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var fields []pgconn.FieldDescription
+	for rows.Next() {
+		if fields == nil {
+			fields = append([]pgconn.FieldDescription(nil), rows.FieldDescriptions()...)
+		}
+
+		values := copyRawValues(rows.RawValues())
+
+		select {
+		case out <- shardRow{shard: i, fields: fields, values: values}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return rows.Err()
+}
+
+// copyRawValues copies raw row values, which pgx reuses for the next row.
+func copyRawValues(raw [][]byte) [][]byte {
+	values := make([][]byte, len(raw))
+	for i, v := range raw {
+		if v != nil {
+			values[i] = append([]byte{}, v...)
+		}
+	}
+	return values
+}
+
+// finish records the errors of the producers and ends the rows.
+func (r *ShardRows) finish(shardErrs *MultiShardError, err error) {
+	if r.abandoned.Load() {
+		shardErrs, err = dropCanceled(shardErrs, err)
+	}
+	r.partial = shardErrs
+	r.err = err
+	close(r.rows)
+}
+
+// ShardID returns the ID of the shard the current row came from.
+func (r *ShardRows) ShardID() string {
+	if r.cur.shard < 0 {
+		return ""
+	}
+	return r.ids[r.cur.shard]
+}
+
+// ShardIndex returns the position, in the topology the query ran on, of the
+// shard the current row came from.
+func (r *ShardRows) ShardIndex() int {
+	return r.cur.shard
+}
+
+// Close stops the queries still running and releases their connections. It is
+// safe to call Close more than once.
+func (r *ShardRows) Close() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.abandoned.Store(true)
+	r.cancel()
+
+	for range r.rows {
+	}
+}
+
+// dropCanceled removes the cancellation errors from the errors of a query.
+func dropCanceled(shardErrs *MultiShardError, err error) (*MultiShardError, error) {
+	if shardErrs != nil {
+		var kept []*ShardError
+		for _, e := range shardErrs.Errors {
+			if !errors.Is(e.Err, context.Canceled) {
+				kept = append(kept, e)
+			}
+		}
+		shardErrs.Errors = kept
+		if len(kept) == 0 {
+			if err == error(shardErrs) {
+				err = nil
+			}
+			shardErrs = nil
+		}
+	}
+
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	return shardErrs, err
+}
+
+// Err returns the error of the query if the failure policy was not
+// satisfied. It should be checked after Next returns false.
+func (r *ShardRows) Err() error {
+	if !r.closed {
+		return nil
+	}
+	return r.err
+}
+
+// ShardErrors returns the errors of the shards that failed, even if the
+// failure policy was satisfied. It should be checked after Next returns false.
+func (r *ShardRows) ShardErrors() *MultiShardError {
+	if !r.closed {
+		return nil
+	}
+	return r.partial
+}
+
+// CommandTag returns a SELECT command tag with the number of rows read.
+func (r *ShardRows) CommandTag() pgconn.CommandTag {
+	return pgconn.NewCommandTag(fmt.Sprintf("SELECT %d", r.count))
+}
+
+// FieldDescriptions returns the field descriptions of the current row.
+func (r *ShardRows) FieldDescriptions() []pgconn.FieldDescription {
+	return r.cur.fields
+}
+
+// Next prepares the next row for reading. It returns false when there are no
+// more rows, after which the rows are closed.
+func (r *ShardRows) Next() bool {
+	if r.closed {
+		return false
+	}
+
+	row, ok := <-r.rows
+	if !ok {
+		r.closed = true
+		r.cancel()
+		r.cur = shardRow{shard: -1}
+		return false
+	}
+
+	r.cur = row
+	r.count++
+	return true
+}
+
+// Scan reads the values of the current row into dest.
+func (r *ShardRows) Scan(dest ...any) error {
+	if r.cur.shard < 0 {
+		return errNoCurrentRow
+	}
+	return scanShardRow(r.typeMap, r.cur, dest...)
+}
+
+// Values returns the decoded values of the current row.
+func (r *ShardRows) Values() ([]any, error) {
+	if r.cur.shard < 0 {
+		return nil, errNoCurrentRow
+	}
+	return decodeShardRow(r.typeMap, r.cur)
+}
+
+// RawValues returns the unparsed bytes of the current row.
+func (r *ShardRows) RawValues() [][]byte {
+	return r.cur.values
+}
+
+// Conn returns nil, as the rows come from several connections.
+func (r *ShardRows) Conn() *pgx.Conn {
+	return nil
+}
+
+// scanShardRow scans the values of row into dest.
+func scanShardRow(typeMap *pgtype.Map, row shardRow, dest ...any) error {
+	return pgx.ScanRow(typeMap, row.fields, row.values, dest...)
+}
+
+// decodeShardRow decodes the values of row the way pgx.Rows.Values does.
+func decodeShardRow(typeMap *pgtype.Map, row shardRow) ([]any, error) {
+	values := make([]any, len(row.fields))
+	for i, fd := range row.fields {
+		value, err := decodeValue(typeMap, fd, row.values[i])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+
+	return values, nil
+}
+
+// decodeValue decodes the raw value of the field described by fd.
+func decodeValue(typeMap *pgtype.Map, fd pgconn.FieldDescription, buf []byte) (any, error) {
+	if buf == nil {
+		return nil, nil
+	}
+
+	if dt, ok := typeMap.TypeForOID(fd.DataTypeOID); ok {
+		return dt.Codec.DecodeValue(typeMap, fd.DataTypeOID, fd.Format, buf)
+	}
+
+	switch fd.Format {
+	case pgx.TextFormatCode:
+		return string(buf), nil
+	case pgx.BinaryFormatCode:
+		return append([]byte{}, buf...), nil
+	}
+
+	return nil, fmt.Errorf("unknown format code %d", fd.Format)
+}
+
+var _ pgx.Rows = (*ShardRows)(nil)
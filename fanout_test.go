@@ -0,0 +1,169 @@
+package pgxshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestDropCanceled(t *testing.T) {
+	failure := errors.New("connection refused")
+	canceled := fmt.Errorf("query: %w", context.Canceled)
+
+	t.Run("only cancellations", func(t *testing.T) {
+		me := &MultiShardError{Shards: 3, Errors: []*ShardError{{ShardID: "a", Err: canceled}, {ShardID: "b", Err: context.Canceled}}}
+		shardErrs, err := dropCanceled(me, me)
+		if shardErrs != nil || err != nil {
+			t.Errorf("dropCanceled = %v, %v, want nil, nil", shardErrs, err)
+		}
+	})
+
+	t.Run("failure kept", func(t *testing.T) {
+		me := &MultiShardError{Shards: 3, Errors: []*ShardError{{ShardID: "a", Err: canceled}, {ShardID: "b", Err: failure}}}
+		shardErrs, err := dropCanceled(me, me)
+		if shardErrs == nil || len(shardErrs.Errors) != 1 || shardErrs.Errors[0].ShardID != "b" {
+			t.Fatalf("shard errors = %v, want the error of shard b", shardErrs)
+		}
+		if !errors.Is(err, failure) {
+			t.Errorf("error = %v, want %v", err, failure)
+		}
+	})
+
+	t.Run("canceled merge", func(t *testing.T) {
+		shardErrs, err := dropCanceled(nil, canceled)
+		if shardErrs != nil || err != nil {
+			t.Errorf("dropCanceled = %v, %v, want nil, nil", shardErrs, err)
+		}
+	})
+
+	t.Run("other error kept", func(t *testing.T) {
+		if _, err := dropCanceled(nil, failure); err != failure {
+			t.Errorf("error = %v, want %v", err, failure)
+		}
+	})
+}
+
+// testTopology returns a topology with n shards named s0, s1... and no pools,
+// for functions that only iterate over shards.
+func testTopology(n int) *topology {
+	t := &topology{pools: make([]*pgxpool.Pool, n), ids: make([]string, n), indexes: make(map[string]int)}
+	for i := range n {
+		t.ids[i] = fmt.Sprintf("s%d", i)
+		t.indexes[t.ids[i]] = i
+	}
+	return t
+}
+
+func TestForEachShardPolicies(t *testing.T) {
+	failure := errors.New("connection refused")
+
+	tests := []struct {
+		name       string
+		policy     FailurePolicy
+		failing    []int
+		wantErr    bool
+		wantFailed []string
+	}{
+		{"fail-fast success", FailFast(), nil, false, nil},
+		{"fail-fast", FailFast(), []int{1}, true, []string{"s1"}},
+		{"best-effort", BestEffort(), []int{0, 2}, false, []string{"s0", "s2"}},
+		{"best-effort all failed", BestEffort(), []int{0, 1, 2}, true, []string{"s0", "s1", "s2"}},
+		{"quorum reached", Quorum(2), []int{2}, false, []string{"s2"}},
+		{"quorum missed", Quorum(2), []int{0, 2}, true, []string{"s0", "s2"}},
+		{"zero quorum", Quorum(0), []int{0, 1, 2}, true, []string{"s0", "s1", "s2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ShardManager{failurePolicy: tt.policy}
+			shardErrs, err := s.forEachShard(context.Background(), testTopology(3), func(ctx context.Context, i int) error {
+				for _, f := range tt.failing {
+					if f == i {
+						return failure
+					}
+				}
+				return nil
+			})
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			var ids []string
+			if shardErrs != nil {
+				ids = shardErrs.ShardIDs()
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.wantFailed) {
+				t.Errorf("failed shards = %v, want %v", ids, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestForEachShardFailFastCancels(t *testing.T) {
+	s := &ShardManager{failurePolicy: FailFast()}
+	failure := errors.New("connection refused")
+
+	shardErrs, err := s.forEachShard(context.Background(), testTopology(3), func(ctx context.Context, i int) error {
+		if i == 0 {
+			return failure
+		}
+		// The other shards run until the failure cancels them.
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	var me *MultiShardError
+	if !errors.As(err, &me) || !errors.Is(err, failure) {
+		t.Fatalf("error = %v, want a *MultiShardError with %v", err, failure)
+	}
+	// The shards canceled by the failure did not fail on their own.
+	if ids := shardErrs.ShardIDs(); fmt.Sprint(ids) != "[s0]" {
+		t.Errorf("failed shards = %v, want [s0]", ids)
+	}
+}
+
+func TestForEachShardUnreachableQuorum(t *testing.T) {
+	s := &ShardManager{failurePolicy: Quorum(4)}
+
+	called := false
+	_, err := s.forEachShard(context.Background(), testTopology(3), func(ctx context.Context, i int) error {
+		called = true
+		return nil
+	})
+	if err == nil {
+		t.Error("quorum of 4 out of 3 shards succeeded")
+	}
+	if called {
+		t.Error("shards were run for an unreachable quorum")
+	}
+}
+
+func TestForEachShardParallelism(t *testing.T) {
+	s := &ShardManager{maxParallelism: 2}
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	_, err := s.forEachShard(context.Background(), testTopology(6), func(ctx context.Context, i int) error {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peak > 2 {
+		t.Errorf("%d shards ran at once, want at most 2", peak)
+	}
+}
@@ -0,0 +1,120 @@
+package pgxshard
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"reflect"
+)
+
+var errKeyTypeNotSupported = errors.New("shard key type not supported")
+
+// Key is the set of key types supported by the shard strategies of this
+// package, besides ShardKey implementations. Types defined on top of them,
+// such as uuid.UUID, are supported too.
+type Key interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~string | ~[]byte | ~[16]byte
+}
+
+// ShardKey is implemented by key types that hash themselves. The hashing
+// strategies use ShardHash in place of their own hash of the key.
+type ShardKey interface {
+	ShardHash() uint64
+}
+
+// normalizeKey converts key to int64, uint64, string, []byte or [16]byte if
+// its type is one of the Key types, and reports whether it did.
+func normalizeKey(key any) (any, bool) {
+	v := reflect.ValueOf(key)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), true
+	case reflect.String:
+		return v.String(), true
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Bytes(), true
+		}
+	case reflect.Array:
+		if v.Len() == 16 && v.Type().Elem().Kind() == reflect.Uint8 {
+			var b [16]byte
+			reflect.Copy(reflect.ValueOf(b[:]), v)
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// keyBytes returns the canonical byte encoding of a shard key used by the
+// hashing strategies. Integer keys are encoded as 8-byte big-endian values so
+// that keys of any integer type holding the same value hash identically,
+// strings and byte slices are used as is and [16]byte keys (such as UUIDs) are
+// used as their 16 raw bytes. ShardKey keys are encoded as their 8-byte
+// big-endian ShardHash. See CompositeKey for the encoding of composite keys.
+//
+// The encoding and hash64 are part of the stability guarantee of the hashing
+// strategies and must not change within a major version of this module.
+func keyBytes(key any) ([]byte, error) {
+	switch v := key.(type) {
+	case CompositeKey:
+		return compositeBytes(v)
+	case ShardKey:
+		return binary.BigEndian.AppendUint64(nil, v.ShardHash()), nil
+	case int:
+		return binary.BigEndian.AppendUint64(nil, uint64(v)), nil
+	case int32:
+		return binary.BigEndian.AppendUint64(nil, uint64(v)), nil
+	case int64:
+		return binary.BigEndian.AppendUint64(nil, uint64(v)), nil
+	case uint64:
+		return binary.BigEndian.AppendUint64(nil, v), nil
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case [16]byte:
+		return v[:], nil
+	}
+
+	if n, ok := normalizeKey(key); ok {
+		return keyBytes(n)
+	}
+	return nil, errKeyTypeNotSupported
+}
+
+// hashKey returns the 64-bit hash of key: its ShardHash if it is a ShardKey,
+// and the hash of its canonical encoding otherwise.
+func hashKey(key any) (uint64, error) {
+	switch k := key.(type) {
+	case CompositeKey:
+		return compositeHash(k)
+	case ShardKey:
+		return k.ShardHash(), nil
+	}
+
+	b, err := keyBytes(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return hash64(b), nil
+}
+
+// hash64 returns the 64-bit FNV-1a hash of b passed through the MurmurHash3
+// finalizer, which spreads short and sequential inputs over the whole range.
+func hash64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,93 @@
+package pgxshard
+
+import "testing"
+
+// hashVectors pin the hashes and shard assignments of the hashing strategies,
+// which must not change within a major version.
+var hashVectors = []struct {
+	key          any
+	hash         uint64
+	jump         int // JumpHash over 16 shards
+	rendezvous   int // RendezvousHash over 16 shards
+	ring         int // ConsistentHash with default virtual nodes over 16 shards
+	rendezvousID string
+	ringID       string
+}{
+	{0, 0x7bd3144f29c0cc9e, 5, 4, 3, "us-2", "eu-2"},
+	{1, 0x0d4ad0eb39c50357, 11, 6, 1, "eu-1", "us-2"},
+	{42, 0x641dede4f0973e8c, 6, 14, 11, "eu-1", "eu-2"},
+	{int64(-7), 0x67200f0076287e12, 7, 5, 2, "us-1", "us-2"},
+	{"", 0xefd01f60ba992926, 1, 10, 15, "eu-1", "us-2"},
+	{"user-1", 0x41a2fca5c68401c5, 15, 11, 12, "us-1", "us-2"},
+	{"tenant/eu", 0x6a2d2b4ad64a1e8f, 6, 8, 2, "eu-2", "us-2"},
+	{[]byte("user-1"), 0x41a2fca5c68401c5, 15, 11, 12, "us-1", "us-2"},
+	{[16]byte{0x12, 0x34}, 0x1f768b55df58b2cc, 7, 11, 8, "us-1", "us-1"},
+}
+
+// vectorShardIDs are the shard IDs the ID variants are checked against.
+var vectorShardIDs = []string{"eu-1", "eu-2", "us-1", "us-2"}
+
+func TestHashKey(t *testing.T) {
+	for _, v := range hashVectors {
+		h, err := hashKey(v.key)
+		if err != nil {
+			t.Fatalf("hashKey(%#v): %v", v.key, err)
+		}
+		if h != v.hash {
+			t.Errorf("hashKey(%#v) = %#x, want %#x", v.key, h, v.hash)
+		}
+	}
+}
+
+func TestKeyBytesIntegerTypes(t *testing.T) {
+	type userID int64
+
+	want, err := keyBytes(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []any{int8(42), int16(42), int32(42), int64(42), uint(42), uint8(42), uint16(42), uint32(42), uint64(42), userID(42)} {
+		got, err := keyBytes(key)
+		if err != nil {
+			t.Fatalf("keyBytes(%T): %v", key, err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("keyBytes(%T(42)) = %x, want %x", key, got, want)
+		}
+	}
+}
+
+func TestKeyBytesUnsupported(t *testing.T) {
+	for _, key := range []any{nil, 1.5, []int{1}, struct{}{}} {
+		if _, err := keyBytes(key); err != errKeyTypeNotSupported {
+			t.Errorf("keyBytes(%#v) error = %v, want %v", key, err, errKeyTypeNotSupported)
+		}
+	}
+}
+
+// checkMovement checks that growing from 8 to 9 shards moves about 1/9 of
+// the keys, and returns the moved keys with their new shard.
+func checkMovement(t *testing.T, f ShardIndexFunc) map[int]int {
+	t.Helper()
+
+	const keys = 100000
+	moved := make(map[int]int)
+	for key := 0; key < keys; key++ {
+		before, err := f(key, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := f(key, 9)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before != after {
+			moved[key] = after
+		}
+	}
+
+	if fraction := float64(len(moved)) / keys; fraction < 0.09 || fraction > 0.135 {
+		t.Errorf("%.1f%% of keys moved from 8 to 9 shards, want about 11.1%%", fraction*100)
+	}
+	return moved
+}
@@ -0,0 +1,185 @@
+package pgxshard
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultHealthTimeout is the default timeout of the health check of a shard.
+const DefaultHealthTimeout = 5 * time.Second
+
+// ShardHealth is the health of a single shard.
+type ShardHealth struct {
+	ShardID string
+	// Latency is the round trip time of the ping.
+	Latency time.Duration
+	// Stat holds the statistics of the shard's pool.
+	Stat *pgxpool.Stat
+	// ServerVersion is the server_version reported by the shard.
+	ServerVersion string
+	// LSN is the current WAL position of a primary, or the WAL position
+	// replayed by a replica. It is 0 if it could not be read.
+	LSN LSN
+	// Lag is the number of WAL bytes a replica has yet to replay, measured
+	// against its primary. It is 0 for primaries.
+	Lag int64
+	// InRecovery reports whether the server is in recovery, which for a
+	// primary means it was demoted.
+	InRecovery bool
+	// Err is the error of the health check, or nil if the shard is healthy.
+	Err error
+	// Replicas holds the health of the read replicas of the shard, identified
+	// as "<shard ID>/replica-<n>".
+	Replicas []ShardHealth
+}
+
+// HealthReport is the health of every shard.
+type HealthReport struct {
+	Shards []ShardHealth
+}
+
+// Healthy reports whether every shard is healthy.
+func (r *HealthReport) Healthy() bool {
+	return r.Err() == nil
+}
+
+// Err returns a *MultiShardError listing the unhealthy shards, or nil if every
+// shard is healthy. Unhealthy replicas are only reported in Replicas.
+func (r *HealthReport) Err() error {
+	me := &MultiShardError{Shards: len(r.Shards)}
+	for _, h := range r.Shards {
+		if h.Err != nil {
+			me.Errors = append(me.Errors, &ShardError{ShardID: h.ShardID, Err: h.Err})
+		}
+	}
+	if len(me.Errors) == 0 {
+		return nil
+	}
+	return me
+}
+
+// Health checks every shard and its replicas concurrently, each within the
+// configured health timeout, and reports their latency, pool statistics,
+// server version and WAL position, and the replication lag of replicas.
+// During a topology transition, the shards of the new layout are included.
+func (s *ShardManager) Health(ctx context.Context) *HealthReport {
+	s.mu.RLock()
+	timeout := s.healthTimeout
+	s.mu.RUnlock()
+
+	shards := s.allShards()
+	report := &HealthReport{Shards: make([]ShardHealth, len(shards))}
+
+	// Replica results are collected apart from the primary results and
+	// attached once every check is done.
+	replicas := make([][]ShardHealth, len(shards))
+
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		replicas[i] = make([]ShardHealth, len(shard.replicas.replicas))
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			report.Shards[i] = checkShard(ctx, shard.id, shard.pool, currentLSNQuery, timeout)
+		}(i)
+
+		for j, r := range shard.replicas.replicas {
+			wg.Add(1)
+			go func(i, j int, r *replica) {
+				defer wg.Done()
+
+				h := checkShard(ctx, r.id, r.pool, replayLSNQuery, timeout)
+				if h.Err == nil {
+					r.observe(h.Latency)
+				}
+				replicas[i][j] = h
+			}(i, j, r)
+		}
+	}
+	wg.Wait()
+
+	for i := range shards {
+		report.Shards[i].Replicas = replicas[i]
+	}
+
+	for i, shard := range shards {
+		primary := report.Shards[i].LSN
+		for j, r := range shard.replicas.replicas {
+			h := &report.Shards[i].Replicas[j]
+			if primary == 0 || h.LSN == 0 {
+				continue
+			}
+			h.Lag = max(int64(primary)-int64(h.LSN), 0)
+			r.replayLSN.Store(uint64(h.LSN))
+			r.lag.Store(h.Lag)
+		}
+	}
+
+	return report
+}
+
+// checkShard pings pool within timeout and reports its health, reading its
+// WAL position with lsnQuery.
+func checkShard(ctx context.Context, id string, pool *pgxpool.Pool, lsnQuery string, timeout time.Duration) ShardHealth {
+	h := ShardHealth{ShardID: id, Stat: pool.Stat()}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		h.Err = err
+		return h
+	}
+	defer conn.Release()
+
+	start := time.Now()
+	if err := conn.Ping(ctx); err != nil {
+		h.Err = err
+		return h
+	}
+	h.Latency = time.Since(start)
+	h.ServerVersion = conn.Conn().PgConn().ParameterStatus("server_version")
+
+	// The WAL position and recovery state are informational: a shard is not
+	// unhealthy because it cannot report them.
+	h.LSN, _ = queryLSN(ctx, conn, lsnQuery)
+	_ = conn.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&h.InRecovery)
+
+	return h
+}
+
+// shardPools holds the pools of a shard.
+type shardPools struct {
+	id       string
+	pool     *pgxpool.Pool
+	replicas *replicaSet
+}
+
+// allShards returns the pools of every shard, including the shards of the
+// new layout during a topology transition.
+func (s *ShardManager) allShards() []shardPools {
+	s.mu.RLock()
+	t, next := s.topo, s.next
+	s.mu.RUnlock()
+
+	var shards []shardPools
+	seen := make(map[*pgxpool.Pool]bool)
+	for _, t := range []*topology{t, next} {
+		if t == nil {
+			continue
+		}
+		for i, pool := range t.pools {
+			if !seen[pool] {
+				seen[pool] = true
+				shards = append(shards, shardPools{id: t.ids[i], pool: pool, replicas: t.replicas[i]})
+			}
+		}
+	}
+
+	return shards
+}
@@ -0,0 +1,241 @@
+package pgxshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrShardUnavailable is matched by the *ShardUnavailableError returned for
+// shards quarantined by the health checker.
+var ErrShardUnavailable = errors.New("shard unavailable")
+
+// ShardUnavailableError is returned instead of the pool of a shard that the
+// health checker marked unhealthy.
+type ShardUnavailableError struct {
+	ShardID string
+}
+
+// Error returns the error message.
+func (e *ShardUnavailableError) Error() string {
+	return fmt.Sprintf("shard %s is unavailable", e.ShardID)
+}
+
+// Is reports whether target is ErrShardUnavailable.
+func (e *ShardUnavailableError) Is(target error) bool {
+	return target == ErrShardUnavailable
+}
+
+// ShardState is the health state of a shard as seen by the health checker.
+type ShardState int
+
+const (
+	// ShardHealthy shards are routed to.
+	ShardHealthy ShardState = iota
+	// ShardUnhealthy shards are quarantined: Shard returns a
+	// *ShardUnavailableError for keys routed to them.
+	ShardUnhealthy
+)
+
+// String returns the name of the state.
+func (s ShardState) String() string {
+	if s == ShardUnhealthy {
+		return "unhealthy"
+	}
+	return "healthy"
+}
+
+// ShardStateChange describes a shard changing health state.
+type ShardStateChange struct {
+	ShardID string
+	State   ShardState
+	// Health is the result of the check that triggered the change.
+	Health ShardHealth
+}
+
+// HealthCheckConfig configures the background health checker.
+type HealthCheckConfig struct {
+	// Interval between two checks of every shard. Defaults to 10 seconds.
+	Interval time.Duration
+	// FailureThreshold is the number of consecutive failed checks after which
+	// a shard is marked unhealthy. Defaults to 3.
+	FailureThreshold int
+	// SuccessThreshold is the number of consecutive successful checks after
+	// which an unhealthy shard is marked healthy again. Defaults to 2.
+	SuccessThreshold int
+	// OnStateChange, if set, is called from the checker goroutine whenever a
+	// shard changes health state.
+	OnStateChange func(ShardStateChange)
+}
+
+// shardCounter counts the consecutive check results of a shard.
+type shardCounter struct {
+	failures  int
+	successes int
+}
+
+// StartHealthChecker starts a goroutine checking every shard with Health at
+// the configured interval until ctx is done, StopHealthChecker is called or
+// the ShardManager is closed. Shards failing FailureThreshold consecutive
+// checks are quarantined, and restored after SuccessThreshold consecutive
+// successful checks. Replicas are quarantined the same way, and skipped by
+// ShardForRead while quarantined. Once ctx is done, StopHealthChecker must be
+// called before the checker can be started again.
+func (s *ShardManager) StartHealthChecker(ctx context.Context, cfg HealthCheckConfig) error {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 3
+	}
+	if cfg.SuccessThreshold <= 0 {
+		cfg.SuccessThreshold = 2
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopHealthChecker != nil {
+		return errors.New("health checker already running")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.stopHealthChecker = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+		s.runHealthChecker(ctx, cfg)
+	}()
+
+	return nil
+}
+
+// StopHealthChecker stops the background health checker and waits for it to
+// exit. Quarantined shards are restored.
+func (s *ShardManager) StopHealthChecker(ctx context.Context) {
+	s.mu.Lock()
+	stop := s.stopHealthChecker
+	s.stopHealthChecker = nil
+	s.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	stop()
+
+	s.mu.Lock()
+	s.unhealthy = make(map[string]bool)
+	s.mu.Unlock()
+}
+
+// ShardState returns the health state of the shard with the provided ID.
+func (s *ShardManager) ShardState(ctx context.Context, id string) ShardState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.unhealthy[id] {
+		return ShardUnhealthy
+	}
+	return ShardHealthy
+}
+
+// runHealthChecker checks every shard at every interval until ctx is done.
+func (s *ShardManager) runHealthChecker(ctx context.Context, cfg HealthCheckConfig) {
+	counters := make(map[string]*shardCounter)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report := s.Health(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		for _, change := range s.applyHealth(report, counters, cfg) {
+			if cfg.OnStateChange != nil {
+				cfg.OnStateChange(change)
+			}
+		}
+
+		for _, h := range report.Shards {
+			if h.Err != nil || h.InRecovery {
+				s.CheckPrimary(ctx, h.ShardID)
+			}
+		}
+	}
+}
+
+// applyHealth updates the shard and replica counters and states from report
+// and returns the state changes.
+func (s *ShardManager) applyHealth(report *HealthReport, counters map[string]*shardCounter, cfg HealthCheckConfig) []ShardStateChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var changes []ShardStateChange
+	apply := func(h ShardHealth) {
+		seen[h.ShardID] = true
+
+		c, ok := counters[h.ShardID]
+		if !ok {
+			c = &shardCounter{}
+			counters[h.ShardID] = c
+		}
+
+		if h.Err != nil {
+			c.failures++
+			c.successes = 0
+			if !s.unhealthy[h.ShardID] && c.failures >= cfg.FailureThreshold {
+				s.unhealthy[h.ShardID] = true
+				changes = append(changes, ShardStateChange{ShardID: h.ShardID, State: ShardUnhealthy, Health: h})
+			}
+		} else {
+			c.successes++
+			c.failures = 0
+			if s.unhealthy[h.ShardID] && c.successes >= cfg.SuccessThreshold {
+				delete(s.unhealthy, h.ShardID)
+				changes = append(changes, ShardStateChange{ShardID: h.ShardID, State: ShardHealthy, Health: h})
+			}
+		}
+	}
+	for _, h := range report.Shards {
+		apply(h)
+		for _, r := range h.Replicas {
+			apply(r)
+		}
+	}
+
+	// Forget the shards removed from the topology.
+	for id := range counters {
+		if !seen[id] {
+			delete(counters, id)
+			delete(s.unhealthy, id)
+		}
+	}
+
+	return changes
+}
+
+// checkAvailable returns a *ShardUnavailableError if the shard with the
+// provided ID is quarantined.
+func (s *ShardManager) checkAvailable(id string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.unhealthy[id] {
+		return &ShardUnavailableError{ShardID: id}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package pgxshard
+
+import "fmt"
+
+// JumpHash is a shard index strategy implementing the Jump Consistent Hash
+// algorithm by Lamping and Veach. It needs no memory and spreads keys evenly,
+// and growing from n to n+1 shards moves only 1/(n+1) of the keys, all of
+// them to the new last shard. Shards can therefore only be added or removed at
+// the end of the shard list.
+//
+// Supported key types are the Key types and ShardKey implementations. The
+// shard returned for a given key and shard count is stable across versions of
+// this module within the same major version.
+func JumpHash(key any, numShards int) (int, error) {
+	if numShards <= 0 {
+		return 0, fmt.Errorf("invalid number of shards %d", numShards)
+	}
+
+	h, err := hashKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return jump(h, numShards), nil
+}
+
+// JumpHashShardID is the shard ID variant of JumpHash. Since jump hashing
+// assigns keys to buckets by position, shards can only be added or removed at
+// the end of ids.
+func JumpHashShardID(key any, ids []string) (string, error) {
+	index, err := JumpHash(key, len(ids))
+	if err != nil {
+		return "", err
+	}
+
+	return ids[index], nil
+}
+
+// jump returns the bucket in [0, n) for the 64-bit key.
+func jump(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
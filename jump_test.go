@@ -0,0 +1,49 @@
+package pgxshard
+
+import "testing"
+
+func TestJump(t *testing.T) {
+	// Reference values of the algorithm published by Lamping and Veach.
+	tests := []struct {
+		key     uint64
+		buckets int
+		want    int
+	}{
+		{1, 1, 0},
+		{42, 57, 43},
+		{0xDEAD10CC, 1, 0},
+		{0xDEAD10CC, 666, 361},
+		{256, 1024, 520},
+	}
+	for _, tt := range tests {
+		if got := jump(tt.key, tt.buckets); got != tt.want {
+			t.Errorf("jump(%d, %d) = %d, want %d", tt.key, tt.buckets, got, tt.want)
+		}
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	for _, v := range hashVectors {
+		got, err := JumpHash(v.key, 16)
+		if err != nil {
+			t.Fatalf("JumpHash(%#v): %v", v.key, err)
+		}
+		if got != v.jump {
+			t.Errorf("JumpHash(%#v, 16) = %d, want %d", v.key, got, v.jump)
+		}
+	}
+}
+
+func TestJumpHashMovement(t *testing.T) {
+	for key, shard := range checkMovement(t, JumpHash) {
+		if shard != 8 {
+			t.Fatalf("key %d moved to shard %d, want the new shard 8", key, shard)
+		}
+	}
+}
+
+func TestJumpHashInvalidShards(t *testing.T) {
+	if _, err := JumpHash(1, 0); err == nil {
+		t.Error("JumpHash with 0 shards succeeded")
+	}
+}
@@ -0,0 +1,103 @@
+package pgxshard
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// GroupByShard groups keys by the index of their shard, keeping the order of
+// keys within each group.
+func (s *ShardManager) GroupByShard(ctx context.Context, keys []any) (map[int][]any, error) {
+	_, groups, err := s.groupByShard(ctx, keys)
+	return groups, err
+}
+
+// groupByShard implements GroupByShard and also returns the topology the
+// indexes refer to.
+func (s *ShardManager) groupByShard(ctx context.Context, keys []any) (*topology, map[int][]any, error) {
+	t, indexFunc, idFunc := s.routing()
+
+	groups, err := groupKeys(ctx, t, indexFunc, idFunc, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, groups, nil
+}
+
+// groupKeys groups keys by the index of their shard in t.
+func groupKeys[K any](ctx context.Context, t *topology, indexFunc ShardIndexContextFunc, idFunc ShardIDFunc, keys []K) (map[int][]K, error) {
+	groups := make(map[int][]K)
+	for _, key := range keys {
+		index, err := t.locate(ctx, key, indexFunc, idFunc)
+		if err != nil {
+			return nil, err
+		}
+		groups[index] = append(groups[index], key)
+	}
+
+	return groups, nil
+}
+
+// QueryKeys executes sql on the shards of keys concurrently, passing every
+// shard the subset of keys it owns as $1, followed by args. The keys of a
+// shard are passed as a slice of their Go type, so they must all have the same
+// type, for use in queries such as "SELECT * FROM users WHERE id = ANY($1)".
+//
+// Rows are merged and shard failures handled as in QueryAll; shards owning
+// none of the keys are not queried.
+func (s *ShardManager) QueryKeys(ctx context.Context, keys []any, sql string, args ...any) (*ShardRows, error) {
+	t, groups, err := s.groupByShard(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	params := make(map[int][]any, len(groups))
+	for index, group := range groups {
+		slice, err := typedSlice(group)
+		if err != nil {
+			return nil, err
+		}
+		params[index] = append([]any{slice}, args...)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := newShardRows(t, cancel)
+
+	go func() {
+		shardErrs, err := s.forEachShard(ctx, t, func(ctx context.Context, i int) error {
+			args, ok := params[i]
+			if !ok {
+				return nil
+			}
+			return produce(ctx, r.rows, i, func(ctx context.Context) (shardRowSource, error) {
+				return t.pools[i].Query(ctx, sql, args...)
+			})
+		})
+		r.finish(shardErrs, err)
+	}()
+
+	return r, nil
+}
+
+// typedSlice returns keys as a slice of their common type, such as []int64 or
+// []string, which pgx encodes as an array of the matching PostgreSQL type.
+func typedSlice(keys []any) (any, error) {
+	typ := reflect.TypeOf(keys[0])
+	if typ == nil {
+		return nil, fmt.Errorf("nil key")
+	}
+
+	slice := reflect.MakeSlice(reflect.SliceOf(typ), len(keys), len(keys))
+	for i, key := range keys {
+		v := reflect.ValueOf(key)
+		if !v.IsValid() {
+			return nil, fmt.Errorf("nil key")
+		}
+		if v.Type() != typ {
+			return nil, fmt.Errorf("keys have different types %s and %s", typ, v.Type())
+		}
+		slice.Index(i).Set(v)
+	}
+	return slice.Interface(), nil
+}
@@ -0,0 +1,48 @@
+package pgxshard
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTypedSlice(t *testing.T) {
+	type tenantID string
+
+	tests := []struct {
+		keys []any
+		want any
+	}{
+		{[]any{int64(1), int64(2)}, []int64{1, 2}},
+		{[]any{1, 2, 3}, []int{1, 2, 3}},
+		{[]any{"a", "b"}, []string{"a", "b"}},
+		{[]any{[16]byte{1}}, [][16]byte{{1}}},
+		{[]any{tenantID("x")}, []tenantID{"x"}},
+	}
+	for _, tt := range tests {
+		got, err := typedSlice(tt.keys)
+		if err != nil {
+			t.Fatalf("typedSlice(%v): %v", tt.keys, err)
+		}
+		if fmt.Sprintf("%T %v", got, got) != fmt.Sprintf("%T %v", tt.want, tt.want) {
+			t.Errorf("typedSlice(%v) = %T %v, want %T %v", tt.keys, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+func TestTypedSliceErrors(t *testing.T) {
+	tests := []struct {
+		keys    []any
+		wantErr string
+	}{
+		{[]any{nil}, "nil key"},
+		{[]any{int64(1), nil}, "nil key"},
+		{[]any{int64(1), 2}, "keys have different types int64 and int"},
+		{[]any{"a", []byte("b")}, "keys have different types string and []uint8"},
+	}
+	for _, tt := range tests {
+		if _, err := typedSlice(tt.keys); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("typedSlice(%v) error = %v, want one containing %q", tt.keys, err, tt.wantErr)
+		}
+	}
+}
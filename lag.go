@@ -0,0 +1,297 @@
+package pgxshard
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// LSN is a PostgreSQL write-ahead log position.
+type LSN uint64
+
+// ParseLSN parses an LSN in the textual form used by PostgreSQL, such as
+// "16/B374D848".
+func ParseLSN(s string) (LSN, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+
+	return LSN(h<<32 | l), nil
+}
+
+// String returns the LSN in the textual form used by PostgreSQL.
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint64(l)>>32, uint64(l)&0xFFFFFFFF)
+}
+
+// rowQuerier is implemented by pools and connections.
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Queries returning the WAL position written by a primary and replayed by a
+// replica.
+const (
+	currentLSNQuery = "SELECT pg_current_wal_lsn()::text"
+	replayLSNQuery  = "SELECT pg_last_wal_replay_lsn()::text"
+)
+
+// queryLSN runs a query returning an LSN. A NULL result is returned as 0.
+func queryLSN(ctx context.Context, q rowQuerier, sql string) (LSN, error) {
+	var s *string
+	if err := q.QueryRow(ctx, sql).Scan(&s); err != nil {
+		return 0, err
+	}
+	if s == nil {
+		return 0, nil
+	}
+	return ParseLSN(*s)
+}
+
+// SessionToken records, per shard, the WAL position of the last write of a
+// session, so that ShardForRead only serves the session's reads from replicas
+// that have replayed its writes. Tokens can be carried between requests in
+// their String form. A SessionToken is safe for concurrent use.
+type SessionToken struct {
+	mu   sync.Mutex
+	lsns map[string]LSN
+}
+
+// NewSessionToken creates an empty SessionToken.
+func NewSessionToken() *SessionToken {
+	return &SessionToken{lsns: make(map[string]LSN)}
+}
+
+// ParseSessionToken parses a SessionToken from its String form.
+func ParseSessionToken(s string) (*SessionToken, error) {
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session token: %w", err)
+	}
+
+	t := NewSessionToken()
+	for id, v := range values {
+		lsn, err := ParseLSN(v[len(v)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid session token: %w", err)
+		}
+		t.lsns[id] = lsn
+	}
+	return t, nil
+}
+
+// String returns the token in a URL-encoded form that can be stored in a
+// cookie or header and read back with ParseSessionToken.
+func (t *SessionToken) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	values := url.Values{}
+	for id, lsn := range t.lsns {
+		values.Set(id, lsn.String())
+	}
+	return values.Encode()
+}
+
+// LSN returns the WAL position of the last write recorded for the shard with
+// the provided ID, or 0 if none was recorded.
+func (t *SessionToken) LSN(shardID string) LSN {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.lsns[shardID]
+}
+
+// Advance records lsn for the shard with the provided ID, unless a later
+// position is already recorded.
+func (t *SessionToken) Advance(shardID string, lsn LSN) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if lsn > t.lsns[shardID] {
+		t.lsns[shardID] = lsn
+	}
+}
+
+// ShardIDs returns the IDs of the shards with recorded writes.
+func (t *SessionToken) ShardIDs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]string, 0, len(t.lsns))
+	for id := range t.lsns {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+type sessionTokenKey struct{}
+
+// WithSessionToken returns a context carrying token, which ShardForRead uses
+// to pick replicas that have replayed the session's writes.
+func WithSessionToken(ctx context.Context, token *SessionToken) context.Context {
+	return context.WithValue(ctx, sessionTokenKey{}, token)
+}
+
+// SessionTokenFromContext returns the token carried by ctx, if any.
+func SessionTokenFromContext(ctx context.Context) (*SessionToken, bool) {
+	token, ok := ctx.Value(sessionTokenKey{}).(*SessionToken)
+	return token, ok
+}
+
+// RecordWrite records in token the current WAL position of the primary of the
+// shard for the provided key. It should be called after a write to the key
+// is committed.
+func (s *ShardManager) RecordWrite(ctx context.Context, key any, token *SessionToken) error {
+	t, index, err := s.locate(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	lsn, err := queryLSN(ctx, t.pools[index], currentLSNQuery)
+	if err != nil {
+		return fmt.Errorf("failed to read WAL position of shard %s: %w", t.ids[index], err)
+	}
+
+	token.Advance(t.ids[index], lsn)
+	return nil
+}
+
+// caughtUp returns the replicas among candidates that have replayed lsn. The
+// replay position of replicas whose last known position is behind lsn is
+// queried again.
+func caughtUp(ctx context.Context, candidates []*replica, lsn LSN) []*replica {
+	var ready []*replica
+	for _, r := range candidates {
+		if LSN(r.replayLSN.Load()) >= lsn {
+			ready = append(ready, r)
+		}
+	}
+	if len(ready) > 0 {
+		return ready
+	}
+
+	for _, r := range candidates {
+		replayed, err := queryLSN(ctx, r.pool, replayLSNQuery)
+		if err != nil {
+			continue
+		}
+		r.replayLSN.Store(uint64(replayed))
+		if replayed >= lsn {
+			ready = append(ready, r)
+		}
+	}
+	return ready
+}
+
+// lagInterval is how often replica lag is measured while a maximum replica
+// lag is set.
+const lagInterval = time.Second
+
+// updateLagTracker starts measuring replica lag in the background if a
+// maximum replica lag is set, and returns the function stopping the tracker
+// if it is no longer needed. It must be called with mu held, and the returned
+// function called after mu is released.
+func (s *ShardManager) updateLagTracker() (stop func()) {
+	if s.maxReplicaLag <= 0 {
+		stop, s.stopLagTracker = s.stopLagTracker, nil
+		return stop
+	}
+	if s.stopLagTracker != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.stopLagTracker = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(lagInterval)
+		defer ticker.Stop()
+
+		for {
+			s.measureLag(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return nil
+}
+
+// stopLagTracking stops the lag tracker, if it is running, and waits for it
+// to exit. The maximum replica lag is kept.
+func (s *ShardManager) stopLagTracking() {
+	s.mu.Lock()
+	stop := s.stopLagTracker
+	s.stopLagTracker = nil
+	s.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
+// measureLag measures the replication lag of every replica, each within the
+// configured health timeout.
+func (s *ShardManager) measureLag(ctx context.Context) {
+	s.mu.RLock()
+	timeout := s.healthTimeout
+	s.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, shard := range s.allShards() {
+		if len(shard.replicas.replicas) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			primary, err := queryLSN(ctx, shard.pool, currentLSNQuery)
+			if err != nil || primary == 0 {
+				return
+			}
+			for _, r := range shard.replicas.replicas {
+				replayed, err := queryLSN(ctx, r.pool, replayLSNQuery)
+				if err != nil || replayed == 0 {
+					continue
+				}
+				r.replayLSN.Store(uint64(replayed))
+				r.lag.Store(max(int64(primary)-int64(replayed), 0))
+			}
+		}()
+	}
+	wg.Wait()
+}
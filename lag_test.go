@@ -0,0 +1,91 @@
+package pgxshard
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestParseLSN(t *testing.T) {
+	tests := []struct {
+		s    string
+		want LSN
+	}{
+		{"0/0", 0},
+		{"16/B374D848", 0x16B374D848},
+		{"0/1", 1},
+		{"FFFFFFFF/FFFFFFFF", LSN(^uint64(0))},
+		{"a/b", 0xA0000000B},
+	}
+	for _, tt := range tests {
+		got, err := ParseLSN(tt.s)
+		if err != nil {
+			t.Fatalf("ParseLSN(%q): %v", tt.s, err)
+		}
+		if got != tt.want {
+			t.Errorf("ParseLSN(%q) = %#x, want %#x", tt.s, uint64(got), uint64(tt.want))
+		}
+
+		back, err := ParseLSN(got.String())
+		if err != nil || back != got {
+			t.Errorf("ParseLSN(%q) = %v, %v, want %v", got.String(), back, err, got)
+		}
+	}
+
+	if got := LSN(0x16B374D848).String(); got != "16/B374D848" {
+		t.Errorf("String() = %q, want 16/B374D848", got)
+	}
+
+	for _, s := range []string{"", "16", "16/", "/1", "G/1", "1/G", "100000000/0", "-1/0"} {
+		if _, err := ParseLSN(s); err == nil {
+			t.Errorf("ParseLSN(%q) succeeded", s)
+		}
+	}
+}
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	token := NewSessionToken()
+	token.Advance("eu-1", 0x16B374D848)
+	token.Advance("us/1", 42)
+	token.Advance("us/1", 7) // earlier positions are ignored
+
+	parsed, err := ParseSessionToken(token.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := parsed.ShardIDs(); fmt.Sprint(ids) != "[eu-1 us/1]" {
+		t.Errorf("ShardIDs() = %v, want [eu-1 us/1]", ids)
+	}
+	if lsn := parsed.LSN("eu-1"); lsn != 0x16B374D848 {
+		t.Errorf("LSN(eu-1) = %v, want 16/B374D848", lsn)
+	}
+	if lsn := parsed.LSN("us/1"); lsn != 42 {
+		t.Errorf("LSN(us/1) = %v, want 0/2A", lsn)
+	}
+	if lsn := parsed.LSN("missing"); lsn != 0 {
+		t.Errorf("LSN(missing) = %v, want 0/0", lsn)
+	}
+
+	empty, err := ParseSessionToken("")
+	if err != nil || len(empty.ShardIDs()) != 0 {
+		t.Errorf("ParseSessionToken(\"\") = %v, %v, want an empty token", empty, err)
+	}
+
+	for _, s := range []string{"eu-1=16", "eu-1=%zz", "eu-1=1/G"} {
+		if _, err := ParseSessionToken(s); err == nil {
+			t.Errorf("ParseSessionToken(%q) succeeded", s)
+		}
+	}
+}
+
+func TestSessionTokenContext(t *testing.T) {
+	if _, ok := SessionTokenFromContext(context.Background()); ok {
+		t.Error("token found in an empty context")
+	}
+
+	token := NewSessionToken()
+	got, ok := SessionTokenFromContext(WithSessionToken(context.Background(), token))
+	if !ok || got != token {
+		t.Errorf("SessionTokenFromContext = %v, %t, want the token", got, ok)
+	}
+}
@@ -0,0 +1,330 @@
+package pgxshard
+
+import (
+	"bytes"
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// SortKey is a column of the ORDER BY clause of a query run on all shards,
+// used to merge the sorted rows of every shard. Like in PostgreSQL, NULL
+// values sort last in ascending order and first in descending order.
+type SortKey struct {
+	Column string
+	Desc   bool
+}
+
+// QueryAllOrdered executes sql, which must sort its rows by orderBy, on every
+// shard and merges the sorted rows of all shards, stopping after limit rows. A
+// non-positive limit returns all rows. Shard failures are handled as in
+// QueryAll.
+//
+// Only the next row of every shard is held while merging, and the queries
+// still running are canceled once limit rows are sent. Since the merge needs
+// the next row of every shard, all shards are queried at once regardless of
+// the maximum parallelism. Strings are compared bytewise, which matches the
+// ordering of the shards only for the C collation.
+func (s *ShardManager) QueryAllOrdered(ctx context.Context, orderBy []SortKey, limit int, sql string, args ...any) (*ShardRows, error) {
+	if len(orderBy) == 0 {
+		return nil, errors.New("no sort keys")
+	}
+
+	t := s.readTopology()
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := newShardRows(t, cancel)
+
+	go func() {
+		// stop cancels the queries once the merge no longer needs their rows.
+		shardCtx, stop := context.WithCancel(ctx)
+		defer stop()
+
+		sources := make([]chan shardRow, len(t.pools))
+		for i := range sources {
+			sources[i] = make(chan shardRow)
+		}
+
+		type fanOut struct {
+			shardErrs *MultiShardError
+			err       error
+		}
+		done := make(chan fanOut, 1)
+		go func() {
+			started := make([]bool, len(t.pools))
+			shardErrs, err := s.forEachShardLimit(shardCtx, t, 0, func(ctx context.Context, i int) error {
+				started[i] = true
+				defer close(sources[i])
+
+				return produce(ctx, sources[i], i, func(ctx context.Context) (shardRowSource, error) {
+					return t.pools[i].Query(ctx, sql, args...)
+				})
+			})
+			// Shards skipped under the failure policy have no rows.
+			for i, ok := range started {
+				if !ok {
+					close(sources[i])
+				}
+			}
+			done <- fanOut{shardErrs, err}
+		}()
+
+		mergeErr := mergeShardRows(ctx, r.rows, sources, orderBy, limit)
+		// Unless the rows were closed, the merge ended on its own and the
+		// queries it cancels did not fail.
+		merged := ctx.Err() == nil
+		stop()
+
+		res := <-done
+		if merged {
+			res.shardErrs, res.err = dropCanceled(res.shardErrs, res.err)
+		}
+		if res.err == nil {
+			res.err = mergeErr
+		}
+		r.finish(res.shardErrs, res.err)
+	}()
+
+	return r, nil
+}
+
+// mergeShardRows sends the rows received from the sources of every shard to
+// out in the order given by orderBy, stopping after limit rows if limit is
+// positive. A row is only received from a shard once its previous row was
+// sent.
+func mergeShardRows(ctx context.Context, out chan<- shardRow, sources []chan shardRow, orderBy []SortKey, limit int) error {
+	h := &rowHeap{typeMap: pgtype.NewMap(), orderBy: orderBy}
+	for _, rows := range sources {
+		c := &rowCursor{rows: rows}
+		ok, err := h.next(ctx, c)
+		if err != nil {
+			return err
+		}
+		// Shards without rows or that failed have no cursor.
+		if ok {
+			h.cursors = append(h.cursors, c)
+		}
+	}
+	heap.Init(h)
+	if h.err != nil {
+		return h.err
+	}
+
+	for sent := 0; h.Len() > 0; {
+		c := h.cursors[0]
+		select {
+		case out <- c.row:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		sent++
+		if limit > 0 && sent == limit {
+			return nil
+		}
+
+		ok, err := h.next(ctx, c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+		if h.err != nil {
+			return h.err
+		}
+	}
+
+	return nil
+}
+
+// rowCursor holds the next row of a shard and its sort values.
+type rowCursor struct {
+	rows    <-chan shardRow
+	row     shardRow
+	columns []int
+	keys    []any
+}
+
+// rowHeap orders shard cursors by the sort values of their next row.
+type rowHeap struct {
+	typeMap *pgtype.Map
+	orderBy []SortKey
+	cursors []*rowCursor
+	err     error
+}
+
+// next receives the next row of the shard of c and decodes its sort values.
+// It returns false once the shard has no more rows.
+func (h *rowHeap) next(ctx context.Context, c *rowCursor) (bool, error) {
+	select {
+	case row, ok := <-c.rows:
+		if !ok {
+			return false, nil
+		}
+		c.row = row
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	if c.columns == nil {
+		c.columns = make([]int, len(h.orderBy))
+		for i, key := range h.orderBy {
+			c.columns[i] = -1
+			for j, fd := range c.row.fields {
+				if fd.Name == key.Column {
+					c.columns[i] = j
+					break
+				}
+			}
+			if c.columns[i] < 0 {
+				return false, fmt.Errorf("sort column %s not found", key.Column)
+			}
+		}
+	}
+
+	var err error
+	c.keys, err = h.sortValues(c, c.row)
+	return err == nil, err
+}
+
+// sortValues decodes the sort columns of row.
+func (h *rowHeap) sortValues(c *rowCursor, row shardRow) ([]any, error) {
+	keys := make([]any, len(c.columns))
+	for i, j := range c.columns {
+		v, err := decodeValue(h.typeMap, row.fields[j], row.values[j])
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = v
+	}
+	return keys, nil
+}
+
+func (h *rowHeap) Len() int { return len(h.cursors) }
+
+func (h *rowHeap) Less(i, j int) bool {
+	a, b := h.cursors[i].keys, h.cursors[j].keys
+	for k, key := range h.orderBy {
+		c, err := compareValues(a[k], b[k])
+		if err != nil {
+			h.err = err
+			return false
+		}
+		if key.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+func (h *rowHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+
+func (h *rowHeap) Push(x any) { h.cursors = append(h.cursors, x.(*rowCursor)) }
+
+func (h *rowHeap) Pop() any {
+	c := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return c
+}
+
+// compareValues compares two decoded column values of the same type. NULL
+// values compare greater than any other value.
+func compareValues(a, b any) (int, error) {
+	switch {
+	case a == nil && b == nil:
+		return 0, nil
+	case a == nil:
+		return 1, nil
+	case b == nil:
+		return -1, nil
+	}
+
+	if x, ok := toInt64(a); ok {
+		if y, ok := toInt64(b); ok {
+			return cmp.Compare(x, y), nil
+		}
+	}
+	if x, ok := toFloat64(a); ok {
+		if y, ok := toFloat64(b); ok {
+			return cmp.Compare(x, y), nil
+		}
+	}
+
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return cmp.Compare(x, y), nil
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y), nil
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, nil
+			case !x:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	case []byte:
+		if y, ok := b.([]byte); ok {
+			return bytes.Compare(x, y), nil
+		}
+	case [16]byte:
+		if y, ok := b.([16]byte); ok {
+			return bytes.Compare(x[:], y[:]), nil
+		}
+	}
+
+	return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+}
+
+// toInt64 converts an integer value to int64.
+func toInt64(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// toFloat64 converts a numeric value to float64.
+func toFloat64(v any) (float64, bool) {
+	if i, ok := toInt64(v); ok {
+		return float64(i), true
+	}
+
+	switch v := v.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case pgtype.Numeric:
+		f, err := v.Float64Value()
+		if err != nil || !f.Valid {
+			return 0, false
+		}
+		return f.Float64, true
+	}
+	return 0, false
+}
@@ -0,0 +1,193 @@
+package pgxshard
+
+import (
+	"context"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestCompareValues(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		a, b any
+		want int
+	}{
+		{nil, nil, 0},
+		{nil, int64(1), 1},
+		{int64(1), nil, -1},
+		{int16(2), int64(10), -1},
+		{int64(10), int32(2), 1},
+		{1.5, int64(1), 1},
+		{float32(2), 2.0, 0},
+		{pgtype.Numeric{Int: big.NewInt(15), Exp: -1, Valid: true}, 1.4, 1},
+		{"a", "b", -1},
+		{"b", "B", 1},
+		{now, now.Add(time.Second), -1},
+		{true, false, 1},
+		{false, false, 0},
+		{[]byte{1, 2}, []byte{1, 3}, -1},
+		{[16]byte{2}, [16]byte{1}, 1},
+	}
+	for _, tt := range tests {
+		got, err := compareValues(tt.a, tt.b)
+		if err != nil {
+			t.Fatalf("compareValues(%#v, %#v): %v", tt.a, tt.b, err)
+		}
+		if got != tt.want {
+			t.Errorf("compareValues(%#v, %#v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	if _, err := compareValues("a", int64(1)); err == nil {
+		t.Error("compareValues of a string and an integer succeeded")
+	}
+}
+
+// int8Fields describes a single bigint column n.
+var int8Fields = []pgconn.FieldDescription{{Name: "n", DataTypeOID: pgtype.Int8OID, Format: pgtype.TextFormatCode}}
+
+// sendRows sends a row per value of ns, nil values being NULL, to a new
+// source of shard i until ctx is done. It returns the source and a function
+// waiting for the producer to exit and returning the number of rows sent.
+func sendRows(ctx context.Context, i int, ns ...any) (chan shardRow, func() int) {
+	rows := make(chan shardRow)
+
+	var wg sync.WaitGroup
+	sent := 0
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(rows)
+
+		for _, n := range ns {
+			var value []byte
+			if n != nil {
+				value = []byte(strconv.Itoa(n.(int)))
+			}
+			select {
+			case rows <- shardRow{shard: i, fields: int8Fields, values: [][]byte{value}}:
+				sent++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return rows, func() int {
+		wg.Wait()
+		return sent
+	}
+}
+
+// mergeRows merges sources and returns the shard and value of every row.
+func mergeRows(t *testing.T, ctx context.Context, sources []chan shardRow, orderBy []SortKey, limit int) ([]string, error) {
+	t.Helper()
+
+	out := make(chan shardRow, 100)
+	err := mergeShardRows(ctx, out, sources, orderBy, limit)
+	close(out)
+
+	var got []string
+	for row := range out {
+		v := "NULL"
+		if row.values[0] != nil {
+			v = string(row.values[0])
+		}
+		got = append(got, strconv.Itoa(row.shard)+":"+v)
+	}
+	return got, err
+}
+
+func TestMergeShardRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		shards  [][]any
+		orderBy []SortKey
+		limit   int
+		want    string
+	}{
+		{
+			name:    "ascending",
+			shards:  [][]any{{1, 4, 5}, {2, 3, 6}, {}},
+			orderBy: []SortKey{{Column: "n"}},
+			want:    "0:1 1:2 1:3 0:4 0:5 1:6",
+		},
+		{
+			name:    "descending with nulls first",
+			shards:  [][]any{{6, 2}, {nil, 5, 1}},
+			orderBy: []SortKey{{Column: "n", Desc: true}},
+			want:    "1:NULL 0:6 1:5 0:2 1:1",
+		},
+		{
+			name:    "ascending with nulls last",
+			shards:  [][]any{{1, nil}, {2}},
+			orderBy: []SortKey{{Column: "n"}},
+			want:    "0:1 1:2 0:NULL",
+		},
+		{
+			name:    "limit",
+			shards:  [][]any{{1, 3, 5}, {2, 4, 6}},
+			orderBy: []SortKey{{Column: "n"}},
+			limit:   4,
+			want:    "0:1 1:2 0:3 1:4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sources := make([]chan shardRow, len(tt.shards))
+			for i, ns := range tt.shards {
+				sources[i], _ = sendRows(ctx, i, ns...)
+			}
+
+			got, err := mergeRows(t, ctx, sources, tt.orderBy, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := strings.Join(got, " "); s != tt.want {
+				t.Errorf("merged %s, want %s", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeShardRowsStopsAtLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a, sentA := sendRows(ctx, 0, 1, 3, 5, 7, 9)
+	b, sentB := sendRows(ctx, 1, 2, 4, 6, 8, 10)
+	if _, err := mergeRows(t, ctx, []chan shardRow{a, b}, []SortKey{{Column: "n"}}, 2); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	// Only the rows needed to pick the first two were read.
+	if n, m := sentA(), sentB(); n != 2 || m != 1 {
+		t.Errorf("read %d and %d rows from the shards, want 2 and 1", n, m)
+	}
+}
+
+func TestMergeShardRowsErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, _ := sendRows(ctx, 0, 1)
+	if _, err := mergeRows(t, ctx, []chan shardRow{a}, []SortKey{{Column: "missing"}}, 0); err == nil || !strings.Contains(err.Error(), "sort column missing not found") {
+		t.Errorf("error = %v, want a missing sort column", err)
+	}
+
+	canceled, stop := context.WithCancel(ctx)
+	stop()
+	if _, err := mergeRows(t, canceled, []chan shardRow{make(chan shardRow)}, []SortKey{{Column: "n"}}, 0); err != context.Canceled {
+		t.Errorf("error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,359 @@
+package pgxshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrationCheckpointTable is the table, created on every source shard, in
+// which Migrate records its progress.
+const migrationCheckpointTable = "pgxshard_migration_checkpoints"
+
+// MigrationTable describes a sharded table whose rows are moved by Migrate.
+type MigrationTable struct {
+	// Name is the table name, optionally schema-qualified.
+	Name string
+	// KeyColumn is the column holding the shard key. It does not need to be
+	// unique, but the table should have a primary key or unique constraint so
+	// that rows copied again when resuming are skipped.
+	KeyColumn string
+	// Columns are the columns to copy. All columns are copied if empty.
+	Columns []string
+}
+
+// MigrationOptions configures Migrate.
+type MigrationOptions struct {
+	// ID identifies the migration in the checkpoint table. Running Migrate
+	// again with the same ID resumes from the last checkpoint.
+	ID string
+	// BatchSize is the number of distinct shard keys read per batch.
+	// Defaults to 1000.
+	BatchSize int
+	// Verify compares the row count and checksum of every copied batch on the
+	// source and destination shards. Verification fails if rows are updated
+	// on the destination while the migration runs.
+	Verify bool
+	// DeleteSource deletes the copied rows from the source shard.
+	DeleteSource bool
+}
+
+// ShardMigrationReport describes the rows migrated from a source shard.
+type ShardMigrationReport struct {
+	ShardID string
+	// Scanned is the number of distinct source keys read.
+	Scanned int64
+	// Moved is the number of rows copied to every destination shard.
+	Moved map[string]int64
+	// Resumed is true if the shard resumed from a checkpoint.
+	Resumed bool
+}
+
+// MigrationReport describes the rows migrated by Migrate.
+type MigrationReport struct {
+	Shards []ShardMigrationReport
+}
+
+// Migrate copies the rows of table whose shard in the to mapping differs from
+// their shard in the from mapping. Rows are read from every shard of from in
+// batches of shard keys, in key order, and copied with COPY to their
+// destination shard in to, skipping rows that already exist there.
+//
+// Progress is checkpointed on every source shard after each batch, so an
+// interrupted migration can be resumed by calling Migrate again with the same
+// migration ID. Both mappings usually come from the same ShardManager, taken
+// before and after AddShard, or with MappingFor before RemoveShard.
+func Migrate(ctx context.Context, from, to *ShardMapping, table MigrationTable, opts MigrationOptions) (*MigrationReport, error) {
+	if opts.ID == "" {
+		return nil, errors.New("migration has no ID")
+	}
+	if table.Name == "" || table.KeyColumn == "" {
+		return nil, errors.New("migration table has no name or key column")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	m := &migration{from: from, to: to, table: table, opts: opts}
+
+	report := &MigrationReport{}
+	for _, id := range from.ShardIDs() {
+		r, err := m.migrateShard(ctx, id)
+		if err != nil {
+			return report, fmt.Errorf("failed to migrate shard %s: %w", id, err)
+		}
+		report.Shards = append(report.Shards, *r)
+	}
+
+	return report, nil
+}
+
+type migration struct {
+	from  *ShardMapping
+	to    *ShardMapping
+	table MigrationTable
+	opts  MigrationOptions
+}
+
+// migrationBatch holds the rows of a batch moving to one destination shard and
+// the text form of their keys.
+type migrationBatch struct {
+	rows [][]any
+	keys []string
+}
+
+// migrateShard moves the rows of the source shard with the provided ID.
+func (m *migration) migrateShard(ctx context.Context, id string) (*ShardMigrationReport, error) {
+	src, err := m.from.pool(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := src.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+migrationCheckpointTable+` (
+		migration_id text NOT NULL,
+		table_name text NOT NULL,
+		last_key text,
+		scanned bigint NOT NULL DEFAULT 0,
+		done boolean NOT NULL DEFAULT false,
+		updated_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (migration_id, table_name)
+	)`); err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint table: %w", err)
+	}
+
+	report := &ShardMigrationReport{ShardID: id, Moved: make(map[string]int64)}
+
+	var lastKey *string
+	var done bool
+	err = src.QueryRow(ctx, `SELECT last_key, scanned, done FROM `+migrationCheckpointTable+`
+		WHERE migration_id = $1 AND table_name = $2`, m.opts.ID, m.table.Name).Scan(&lastKey, &report.Scanned, &done)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	default:
+		report.Resumed = true
+	}
+	if done {
+		return report, nil
+	}
+
+	var keyType string
+	if err := src.QueryRow(ctx, `SELECT format_type(atttypid, atttypmod) FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attname = $2 AND NOT attisdropped`, m.table.Name, m.table.KeyColumn).Scan(&keyType); err != nil {
+		return nil, fmt.Errorf("failed to read type of key column %s: %w", m.table.KeyColumn, err)
+	}
+
+	tableName := sanitizeTable(m.table.Name)
+	keyColumn := pgx.Identifier{m.table.KeyColumn}.Sanitize()
+	columns := "*"
+	if len(m.table.Columns) > 0 {
+		columns = sanitizeColumns(m.table.Columns)
+	}
+
+	for {
+		sql := `SELECT DISTINCT ` + keyColumn + `, ` + keyColumn + `::text FROM ` + tableName
+		args := []any{}
+		if lastKey != nil {
+			sql += ` WHERE ` + keyColumn + ` > $1::text::` + keyType
+			args = append(args, *lastKey)
+		}
+		sql += ` ORDER BY 1 LIMIT ` + fmt.Sprint(m.opts.BatchSize)
+
+		keys, n, last, err := m.readKeys(ctx, src, id, sql, args)
+		if err != nil {
+			return nil, err
+		}
+		report.Scanned += int64(n)
+
+		batches, names, err := m.readRows(ctx, src, columns, keyType, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		for dst, b := range batches {
+			if err := m.copyBatch(ctx, src, dst, names, keyType, b); err != nil {
+				return nil, fmt.Errorf("failed to copy rows to shard %s: %w", dst, err)
+			}
+			report.Moved[dst] += int64(len(b.rows))
+		}
+
+		if n > 0 {
+			lastKey = &last
+		}
+		done = n < m.opts.BatchSize
+
+		if _, err := src.Exec(ctx, `INSERT INTO `+migrationCheckpointTable+` (migration_id, table_name, last_key, scanned, done)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (migration_id, table_name) DO UPDATE
+			SET last_key = EXCLUDED.last_key, scanned = EXCLUDED.scanned, done = EXCLUDED.done, updated_at = now()`,
+			m.opts.ID, m.table.Name, lastKey, report.Scanned, done); err != nil {
+			return nil, fmt.Errorf("failed to write checkpoint: %w", err)
+		}
+
+		if done {
+			return report, nil
+		}
+	}
+}
+
+// readKeys reads a batch of distinct source keys and groups the keys that move
+// by destination shard. It returns the groups, the number of keys read and the
+// text form of the last key read.
+func (m *migration) readKeys(ctx context.Context, src *pgxpool.Pool, id, sql string, args []any) (map[string][]string, int, string, error) {
+	rows, err := src.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to read keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make(map[string][]string)
+	var n int
+	var last string
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, 0, "", err
+		}
+		n++
+		last = values[1].(string)
+
+		dst, err := m.to.ShardID(ctx, values[0])
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("failed to route key %s: %w", last, err)
+		}
+		if dst != id {
+			keys[dst] = append(keys[dst], last)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, "", fmt.Errorf("failed to read keys: %w", err)
+	}
+
+	return keys, n, last, nil
+}
+
+// readRows reads the source rows of the grouped keys. It returns the rows by
+// destination shard and the names of the columns read.
+func (m *migration) readRows(ctx context.Context, src *pgxpool.Pool, columns, keyType string, keys map[string][]string) (map[string]*migrationBatch, []string, error) {
+	batches := make(map[string]*migrationBatch)
+	var names []string
+
+	for dst, dstKeys := range keys {
+		rows, err := src.Query(ctx, `SELECT `+columns+` FROM `+sanitizeTable(m.table.Name)+
+			m.keyFilter(keyType), dstKeys)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read rows: %w", err)
+		}
+
+		b := &migrationBatch{keys: dstKeys}
+		for rows.Next() {
+			values, err := rows.Values()
+			if err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			b.rows = append(b.rows, values)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, fmt.Errorf("failed to read rows: %w", err)
+		}
+
+		if names == nil {
+			for _, f := range rows.FieldDescriptions() {
+				names = append(names, f.Name)
+			}
+		}
+		batches[dst] = b
+	}
+
+	return batches, names, nil
+}
+
+// keyFilter returns the WHERE clause matching the keys passed as a text array
+// in $1.
+func (m *migration) keyFilter(keyType string) string {
+	return ` WHERE ` + pgx.Identifier{m.table.KeyColumn}.Sanitize() + ` = ANY($1::text[]::` + keyType + `[])`
+}
+
+// copyBatch copies a batch to the destination shard through a temporary table,
+// skipping rows that already exist, then verifies and deletes it from the
+// source shard as configured.
+func (m *migration) copyBatch(ctx context.Context, src *pgxpool.Pool, dstID string, names []string, keyType string, b *migrationBatch) error {
+	dst, err := m.to.pool(dstID)
+	if err != nil {
+		return err
+	}
+
+	tableName := sanitizeTable(m.table.Name)
+	columns := sanitizeColumns(names)
+
+	err = pgx.BeginFunc(ctx, dst, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `CREATE TEMPORARY TABLE pgxshard_migration ON COMMIT DROP AS
+			SELECT `+columns+` FROM `+tableName+` WITH NO DATA`); err != nil {
+			return err
+		}
+
+		n, err := tx.CopyFrom(ctx, pgx.Identifier{"pgxshard_migration"}, names, pgx.CopyFromRows(b.rows))
+		if err != nil {
+			return err
+		}
+		if n != int64(len(b.rows)) {
+			return fmt.Errorf("copied %d rows, expected %d", n, len(b.rows))
+		}
+
+		_, err = tx.Exec(ctx, `INSERT INTO `+tableName+` (`+columns+`)
+			SELECT `+columns+` FROM pgxshard_migration ON CONFLICT DO NOTHING`)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	keyFilter := m.keyFilter(keyType)
+
+	if m.opts.Verify {
+		sql := `SELECT count(*), coalesce(md5(string_agg(h, '' ORDER BY h)), '')
+			FROM (SELECT md5(ROW(` + columns + `)::text) AS h FROM ` + tableName + keyFilter + `) t`
+
+		var srcCount, dstCount int64
+		var srcSum, dstSum string
+		if err := src.QueryRow(ctx, sql, b.keys).Scan(&srcCount, &srcSum); err != nil {
+			return fmt.Errorf("failed to verify source rows: %w", err)
+		}
+		if err := dst.QueryRow(ctx, sql, b.keys).Scan(&dstCount, &dstSum); err != nil {
+			return fmt.Errorf("failed to verify destination rows: %w", err)
+		}
+		if srcCount != dstCount || srcSum != dstSum {
+			return fmt.Errorf("verification failed: source has %d rows with checksum %q, destination has %d rows with checksum %q",
+				srcCount, srcSum, dstCount, dstSum)
+		}
+	}
+
+	if m.opts.DeleteSource {
+		if _, err := src.Exec(ctx, `DELETE FROM `+tableName+keyFilter, b.keys); err != nil {
+			return fmt.Errorf("failed to delete source rows: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// sanitizeTable quotes an optionally schema-qualified table name.
+func sanitizeTable(name string) string {
+	return pgx.Identifier(strings.Split(name, ".")).Sanitize()
+}
+
+// sanitizeColumns quotes and joins column names.
+func sanitizeColumns(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = pgx.Identifier{name}.Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
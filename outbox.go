@@ -0,0 +1,283 @@
+package pgxshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Tables of the transactional outbox, created on every shard by
+// CreateOutboxTables.
+const (
+	outboxTable     = "pgxshard_outbox"
+	deadLetterTable = "pgxshard_outbox_dead_letters"
+)
+
+// OutboxMessage is a message written to the outbox of a shard.
+type OutboxMessage struct {
+	// ID is the ID of the message in the outbox of its shard.
+	ID int64
+	// ShardID is the ID of the shard the message was written on.
+	ShardID string
+	Topic   string
+	Payload []byte
+	// Attempts is the number of failed deliveries of the message so far.
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// OutboxHandler handles the messages of a topic. A message is delivered at
+// least once: it is delivered again if the handler returns an error, and may
+// be delivered again if the relay stops before recording the delivery.
+type OutboxHandler func(ctx context.Context, msg OutboxMessage) error
+
+// RelayConfig configures the outbox relay.
+type RelayConfig struct {
+	// Handlers are the handlers by topic. Messages of a topic without a handler
+	// fail delivery.
+	Handlers map[string]OutboxHandler
+	// Interval between two polls of every shard. Defaults to 1 second.
+	Interval time.Duration
+	// BatchSize is the maximum number of messages claimed per shard and poll.
+	// Defaults to 100.
+	BatchSize int
+	// MaxAttempts is the number of failed deliveries after which a message is
+	// moved to the dead-letter table. Defaults to 10.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry, doubled on every
+	// following retry up to MaxBackoff. Default to 1 second and 5 minutes
+	// respectively.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnDeadLetter, if set, is called from the relay goroutine when a message
+	// is moved to the dead-letter table, with the error of its last delivery.
+	OnDeadLetter func(OutboxMessage, error)
+	// OnError, if set, is called from the relay goroutine when polling a shard
+	// fails.
+	OnError func(shardID string, err error)
+}
+
+// backoff returns the delay before the retry following the provided number of
+// failed deliveries.
+func (cfg RelayConfig) backoff(attempts int) time.Duration {
+	d := cfg.MinBackoff
+	for i := 1; i < attempts && d < cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, cfg.MaxBackoff)
+}
+
+// CreateOutboxTables creates the outbox and dead-letter tables on every shard
+// if they do not exist.
+func (s *ShardManager) CreateOutboxTables(ctx context.Context) error {
+	t := s.topology()
+
+	_, err := s.forEachShard(ctx, t, func(ctx context.Context, i int) error {
+		_, err := t.pools[i].Exec(ctx, `CREATE TABLE IF NOT EXISTS `+outboxTable+` (
+			id bigserial PRIMARY KEY,
+			topic text NOT NULL,
+			payload bytea NOT NULL,
+			attempts int NOT NULL DEFAULT 0,
+			last_error text,
+			created_at timestamptz NOT NULL DEFAULT now(),
+			available_at timestamptz NOT NULL DEFAULT now()
+		);
+		CREATE TABLE IF NOT EXISTS `+deadLetterTable+` (
+			id bigint PRIMARY KEY,
+			topic text NOT NULL,
+			payload bytea NOT NULL,
+			attempts int NOT NULL,
+			last_error text,
+			created_at timestamptz NOT NULL,
+			failed_at timestamptz NOT NULL DEFAULT now()
+		)`)
+		return err
+	})
+	return err
+}
+
+// WriteOutbox writes a message to the outbox in tx, so that it is relayed if
+// and only if tx commits. tx must be a transaction on a shard of the
+// ShardManager relaying the outbox.
+func WriteOutbox(ctx context.Context, tx pgx.Tx, topic string, payload []byte) error {
+	_, err := tx.Exec(ctx, `INSERT INTO `+outboxTable+` (topic, payload) VALUES ($1, $2)`, topic, payload)
+	return err
+}
+
+// StartOutboxRelay starts a goroutine polling the outbox of every shard at the
+// configured interval and delivering the messages to their handlers, until ctx
+// is done, StopOutboxRelay is called or the ShardManager is closed. Messages
+// are claimed with FOR UPDATE SKIP LOCKED, so relays of several processes can
+// run side by side. Messages are delivered in ID order per shard, but a failed
+// message does not hold back the next ones.
+func (s *ShardManager) StartOutboxRelay(ctx context.Context, cfg RelayConfig) error {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 10
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopOutboxRelay != nil {
+		return errors.New("outbox relay already running")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.stopOutboxRelay = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+		s.runOutboxRelay(ctx, cfg)
+	}()
+
+	return nil
+}
+
+// StopOutboxRelay stops the outbox relay and waits for it to exit.
+func (s *ShardManager) StopOutboxRelay(ctx context.Context) {
+	s.mu.Lock()
+	stop := s.stopOutboxRelay
+	s.stopOutboxRelay = nil
+	s.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
+// runOutboxRelay polls every shard at every interval until ctx is done.
+func (s *ShardManager) runOutboxRelay(ctx context.Context, cfg RelayConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, shard := range s.allShards() {
+			if s.checkAvailable(shard.id) != nil {
+				continue
+			}
+
+			// Drain the shard before moving on, as long as full batches are
+			// claimed.
+			for {
+				n, err := s.relayBatch(ctx, shard.id, shard.pool, cfg)
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil && cfg.OnError != nil {
+					cfg.OnError(shard.id, err)
+				}
+				if err != nil || n < cfg.BatchSize {
+					break
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayBatch claims up to BatchSize messages due on the shard and delivers
+// them, returning the number of messages claimed.
+func (s *ShardManager) relayBatch(ctx context.Context, shardID string, pool *pgxpool.Pool, cfg RelayConfig) (int, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `SELECT id, topic, payload, attempts, created_at FROM `+outboxTable+`
+		WHERE available_at <= now()
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`, cfg.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	msgs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (OutboxMessage, error) {
+		msg := OutboxMessage{ShardID: shardID}
+		err := row.Scan(&msg.ID, &msg.Topic, &msg.Payload, &msg.Attempts, &msg.CreatedAt)
+		return msg, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	type deadLetter struct {
+		msg OutboxMessage
+		err error
+	}
+	var dead []deadLetter
+
+	for _, msg := range msgs {
+		err := deliver(ctx, cfg, msg)
+		if ctx.Err() != nil {
+			return len(msgs), ctx.Err()
+		}
+
+		switch {
+		case err == nil:
+			_, err = tx.Exec(ctx, `DELETE FROM `+outboxTable+` WHERE id = $1`, msg.ID)
+		case msg.Attempts+1 >= cfg.MaxAttempts:
+			deliveryErr := err
+			_, err = tx.Exec(ctx, `WITH moved AS (
+				DELETE FROM `+outboxTable+` WHERE id = $1
+				RETURNING id, topic, payload, attempts, created_at
+			)
+			INSERT INTO `+deadLetterTable+` (id, topic, payload, attempts, last_error, created_at)
+			SELECT id, topic, payload, attempts + 1, $2, created_at FROM moved`, msg.ID, deliveryErr.Error())
+			msg.Attempts++
+			dead = append(dead, deadLetter{msg: msg, err: deliveryErr})
+		default:
+			_, err = tx.Exec(ctx, `UPDATE `+outboxTable+`
+				SET attempts = attempts + 1, last_error = $2, available_at = now() + make_interval(secs => $3)
+				WHERE id = $1`, msg.ID, err.Error(), cfg.backoff(msg.Attempts+1).Seconds())
+		}
+		if err != nil {
+			return len(msgs), err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return len(msgs), err
+	}
+
+	if cfg.OnDeadLetter != nil {
+		for _, d := range dead {
+			cfg.OnDeadLetter(d.msg, d.err)
+		}
+	}
+	return len(msgs), nil
+}
+
+// deliver passes msg to the handler of its topic.
+func deliver(ctx context.Context, cfg RelayConfig, msg OutboxMessage) error {
+	handler, ok := cfg.Handlers[msg.Topic]
+	if !ok {
+		return fmt.Errorf("no handler for topic %q", msg.Topic)
+	}
+	return handler(ctx, msg)
+}
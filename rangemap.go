@@ -0,0 +1,296 @@
+package pgxshard
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// KeyRange maps the keys in [Start, End) to the shard at index Shard. A nil
+// Start or End leaves the range unbounded on that side.
+//
+// Bounds are integers, strings, byte slices or time.Time values, including
+// types defined on top of them; integers of different types are compared by
+// value, and byte slices as strings. [16]byte and ShardKey keys have no
+// meaningful order and are not supported.
+type KeyRange struct {
+	Start any
+	End   any
+	Shard int
+}
+
+// RangeShardMap is a shard index strategy mapping ordered key ranges to
+// shards, for tables partitioned by ranges of IDs, names or timestamps.
+//
+// Its ShardIndex method can be installed with ShardManager.SetShardIndexFunc
+// or WithShardIndexFunc.
+type RangeShardMap struct {
+	ranges []KeyRange
+}
+
+// NewRangeShardMap creates a RangeShardMap from the provided ranges, which may
+// be given in any order. It returns an error if the bounds are not all of the
+// same kind, or if the ranges overlap or leave gaps between each other.
+func NewRangeShardMap(ranges []KeyRange) (*RangeShardMap, error) {
+	if len(ranges) == 0 {
+		return nil, errors.New("range shard map has no ranges")
+	}
+
+	sorted := make([]KeyRange, len(ranges))
+	for i, r := range ranges {
+		start, err := rangeBound(r.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start of range %d: %w", i, err)
+		}
+		end, err := rangeBound(r.End)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end of range %d: %w", i, err)
+		}
+		if r.Shard < 0 {
+			return nil, fmt.Errorf("invalid shard %d of range %d", r.Shard, i)
+		}
+		sorted[i] = KeyRange{Start: start, End: end, Shard: r.Shard}
+	}
+
+	var sortErr error
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Start == nil || sorted[j].Start == nil {
+			return sorted[i].Start == nil && sorted[j].Start != nil
+		}
+		c, err := compareRangeKeys(sorted[i].Start, sorted[j].Start)
+		if err != nil {
+			sortErr = err
+		}
+		return c < 0
+	})
+	if sortErr != nil {
+		return nil, sortErr
+	}
+
+	for i, r := range sorted {
+		if r.Start != nil && r.End != nil {
+			c, err := compareRangeKeys(r.Start, r.End)
+			if err != nil {
+				return nil, err
+			}
+			if c >= 0 {
+				return nil, fmt.Errorf("range [%v, %v) is empty", r.Start, r.End)
+			}
+		}
+		if i == 0 {
+			continue
+		}
+
+		prev := sorted[i-1]
+		if prev.End == nil || r.Start == nil {
+			return nil, fmt.Errorf("range [%v, %v) overlaps range [%v, %v)", r.Start, r.End, prev.Start, prev.End)
+		}
+		c, err := compareRangeKeys(prev.End, r.Start)
+		if err != nil {
+			return nil, err
+		}
+		if c > 0 {
+			return nil, fmt.Errorf("range [%v, %v) overlaps range [%v, %v)", r.Start, r.End, prev.Start, prev.End)
+		}
+		if c < 0 {
+			return nil, fmt.Errorf("gap between %v and %v", prev.End, r.Start)
+		}
+	}
+
+	return &RangeShardMap{ranges: sorted}, nil
+}
+
+// Ranges returns the ranges of the map ordered by their start.
+func (m *RangeShardMap) Ranges() []KeyRange {
+	return append([]KeyRange(nil), m.ranges...)
+}
+
+// ShardIndex returns the shard of the range containing key.
+func (m *RangeShardMap) ShardIndex(key any, numShards int) (int, error) {
+	k, err := rangeBound(key)
+	if err != nil {
+		return 0, err
+	}
+	if k == nil {
+		return 0, errors.New("shard key is nil")
+	}
+
+	var cmpErr error
+	i := sort.Search(len(m.ranges), func(i int) bool {
+		if m.ranges[i].End == nil {
+			return true
+		}
+		c, err := compareRangeKeys(k, m.ranges[i].End)
+		if err != nil {
+			cmpErr = err
+		}
+		return c < 0
+	})
+	if cmpErr != nil {
+		return 0, cmpErr
+	}
+
+	if i < len(m.ranges) {
+		r := m.ranges[i]
+		c := -1
+		if r.Start != nil {
+			c, err = compareRangeKeys(r.Start, k)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if c <= 0 {
+			if r.Shard >= numShards {
+				return 0, fmt.Errorf("shard index %d is out of range", r.Shard)
+			}
+			return r.Shard, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no range contains shard key %v", key)
+}
+
+// rangeBound normalizes a range bound or key, widening integers to int64.
+func rangeBound(v any) (any, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64, string, time.Time:
+		return v, nil
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), nil
+		}
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case CompositeKey:
+		if len(v) == 1 {
+			return rangeBound(v[0])
+		}
+		return nil, errKeyTypeNotSupported
+	}
+
+	if n, ok := normalizeKey(v); ok {
+		if _, ok := n.([16]byte); !ok {
+			return rangeBound(n)
+		}
+	}
+	return nil, errKeyTypeNotSupported
+}
+
+// compareRangeKeys compares two normalized range keys of the same kind.
+func compareRangeKeys(a, b any) (int, error) {
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return cmp.Compare(a, b), nil
+		case uint64:
+			// b is normalized to uint64 only above math.MaxInt64.
+			return -1, nil
+		}
+	case uint64:
+		switch b := b.(type) {
+		case int64:
+			return 1, nil
+		case uint64:
+			return cmp.Compare(a, b), nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a > b:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b), nil
+		}
+	}
+
+	return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+}
+
+// rangeShardMapConfig is the JSON representation of a RangeShardMap read by
+// LoadRangeShardMap.
+type rangeShardMapConfig struct {
+	Type   string `json:"type"`
+	Ranges []struct {
+		Start json.RawMessage `json:"start"`
+		End   json.RawMessage `json:"end"`
+		Shard int             `json:"shard"`
+	} `json:"ranges"`
+}
+
+// LoadRangeShardMap reads a RangeShardMap from its JSON configuration:
+//
+//	{
+//		"type": "int",
+//		"ranges": [
+//			{"end": 1000, "shard": 0},
+//			{"start": 1000, "end": 5000, "shard": 1},
+//			{"start": 5000, "shard": 2}
+//		]
+//	}
+//
+// The type is one of "int", "string" or "time"; time bounds are RFC 3339
+// strings. Omitted or null bounds leave the range unbounded.
+func LoadRangeShardMap(r io.Reader) (*RangeShardMap, error) {
+	var cfg rangeShardMapConfig
+	if err := json.NewDecoder(r).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode range shard map: %w", err)
+	}
+
+	ranges := make([]KeyRange, len(cfg.Ranges))
+	for i, r := range cfg.Ranges {
+		start, err := parseRangeBound(cfg.Type, r.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start of range %d: %w", i, err)
+		}
+		end, err := parseRangeBound(cfg.Type, r.End)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end of range %d: %w", i, err)
+		}
+		ranges[i] = KeyRange{Start: start, End: end, Shard: r.Shard}
+	}
+
+	return NewRangeShardMap(ranges)
+}
+
+// parseRangeBound decodes a JSON range bound of the given type.
+func parseRangeBound(typ string, raw json.RawMessage) (any, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	switch typ {
+	case "int":
+		var v int64
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case "string":
+		var v string
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case "time":
+		var v time.Time
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	}
+
+	return nil, fmt.Errorf("unknown range type %q", typ)
+}
@@ -0,0 +1,102 @@
+package pgxshard
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewRangeShardMapValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  []KeyRange
+		wantErr string
+	}{
+		{
+			name:   "contiguous",
+			ranges: []KeyRange{{Start: 100, End: 200, Shard: 1}, {End: 100, Shard: 0}, {Start: 200, Shard: 2}},
+		},
+		{
+			name:    "overlap",
+			ranges:  []KeyRange{{End: 150, Shard: 0}, {Start: 100, Shard: 1}},
+			wantErr: "overlaps",
+		},
+		{
+			name:    "two unbounded starts",
+			ranges:  []KeyRange{{End: 100, Shard: 0}, {End: 200, Shard: 1}},
+			wantErr: "overlaps",
+		},
+		{
+			name:    "gap",
+			ranges:  []KeyRange{{End: 100, Shard: 0}, {Start: 150, Shard: 1}},
+			wantErr: "gap between 100 and 150",
+		},
+		{
+			name:    "empty range",
+			ranges:  []KeyRange{{Start: 100, End: 100, Shard: 0}},
+			wantErr: "is empty",
+		},
+		{
+			name:    "mixed kinds",
+			ranges:  []KeyRange{{End: 100, Shard: 0}, {Start: "a", Shard: 1}},
+			wantErr: "cannot compare",
+		},
+		{
+			name:    "negative shard",
+			ranges:  []KeyRange{{Shard: -1}},
+			wantErr: "invalid shard",
+		},
+		{
+			name:    "no ranges",
+			wantErr: "no ranges",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRangeShardMap(tt.ranges)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRangeShardMapShardIndex(t *testing.T) {
+	m, err := NewRangeShardMap([]KeyRange{
+		{End: 100, Shard: 0},
+		{Start: 100, End: 200, Shard: 1},
+		{Start: 200, Shard: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key  any
+		want int
+	}{
+		{-5, 0},
+		{99, 0},
+		{100, 1},
+		{int32(199), 1},
+		{uint64(200), 2},
+		{CompositeKey{int16(150)}, 1},
+	}
+	for _, tt := range tests {
+		got, err := m.ShardIndex(tt.key, 3)
+		if err != nil {
+			t.Fatalf("ShardIndex(%#v): %v", tt.key, err)
+		}
+		if got != tt.want {
+			t.Errorf("ShardIndex(%#v) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+
+	for _, key := range []any{"a", [16]byte{}, CompositeKey{1, 2}} {
+		if _, err := m.ShardIndex(key, 3); err == nil {
+			t.Errorf("ShardIndex(%#v) succeeded", key)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package pgxshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultRecoveryMinAge is the minimum age of the distributed transactions
+// resolved by RecoverPrepared unless RecoveryOptions.MinAge is set.
+const DefaultRecoveryMinAge = 5 * time.Minute
+
+// RecoveryOptions configures RecoverPrepared.
+type RecoveryOptions struct {
+	// DryRun reports the decisions without resolving any transaction.
+	DryRun bool
+	// MinAge skips distributed transactions with a participant prepared less
+	// than MinAge ago, which may still be finished by their coordinator.
+	// Defaults to DefaultRecoveryMinAge; a negative MinAge disables the check.
+	MinAge time.Duration
+}
+
+// RecoveryAction is the resolution of a prepared transaction found on a
+// shard.
+type RecoveryAction struct {
+	// TransactionID is the ID of the distributed transaction.
+	TransactionID string
+	// ShardID is the ID of the shard the transaction is prepared on.
+	ShardID string
+	// GID is the global transaction ID of the prepared transaction.
+	GID string
+	// Prepared is the time the transaction was prepared.
+	Prepared time.Time
+	// Commit is true if the transaction is committed and false if it is
+	// rolled back.
+	Commit bool
+	// Err is the error resolving the transaction, if any.
+	Err error
+}
+
+// RecoveryReport is the result of RecoverPrepared.
+type RecoveryReport struct {
+	// Actions are the resolutions of the prepared transactions found, grouped
+	// by distributed transaction.
+	Actions []RecoveryAction
+	// Skipped are the IDs of the distributed transactions left alone because
+	// they are younger than MinAge.
+	Skipped []string
+}
+
+// Err returns the errors of the actions that failed, or nil.
+func (r *RecoveryReport) Err() error {
+	var errs []error
+	for _, a := range r.Actions {
+		if a.Err != nil {
+			errs = append(errs, &ShardError{ShardID: a.ShardID, Err: a.Err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// preparedXact is a prepared transaction of a distributed transaction found in
+// pg_prepared_xacts.
+type preparedXact struct {
+	pool         *pgxpool.Pool
+	gid          string
+	txID         string
+	participants int
+	shardID      string
+	prepared     time.Time
+	age          time.Duration
+}
+
+// loggedTx is the coordinator log entry of a distributed transaction.
+type loggedTx struct {
+	participants []string
+	decision     string
+}
+
+// RecoverPrepared resolves the prepared transactions left behind by
+// distributed transactions whose coordinator did not finish them. It scans
+// pg_prepared_xacts on every shard and groups the prepared transactions by
+// distributed transaction. It returns ErrNoCoordinator if no coordinator pool
+// is configured.
+//
+// The decision recorded in the coordinator log is applied if there is one: a
+// transaction is committed only if its commit decision was recorded. A
+// transaction without a decision yet is aborted by recording the abort
+// decision first, so that its coordinator can no longer commit it. Without a
+// coordinator log entry, a transaction is committed if every participant
+// prepared and rolled back otherwise. The log entry is deleted once every
+// participant it lists is resolved.
+//
+// Shards that cannot be scanned are reported as a *MultiShardError along with
+// the report of the other shards.
+func (s *ShardManager) RecoverPrepared(ctx context.Context, opts RecoveryOptions) (*RecoveryReport, error) {
+	coordinator, err := s.coordinatorPool()
+	if err != nil {
+		return nil, err
+	}
+	if opts.MinAge == 0 {
+		opts.MinAge = DefaultRecoveryMinAge
+	}
+
+	xacts, scanned, scanErr := s.scanPrepared(ctx)
+
+	groups := make(map[string][]preparedXact)
+	var order []string
+	for _, x := range xacts {
+		if _, ok := groups[x.txID]; !ok {
+			order = append(order, x.txID)
+		}
+		groups[x.txID] = append(groups[x.txID], x)
+	}
+
+	logged, err := loggedTransactions(ctx, coordinator, order)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RecoveryReport{}
+	for _, txID := range order {
+		group := groups[txID]
+
+		young := false
+		for _, x := range group {
+			if x.age < opts.MinAge {
+				young = true
+			}
+		}
+		if young {
+			report.Skipped = append(report.Skipped, txID)
+			continue
+		}
+
+		var commit bool
+		var claimErr error
+		entry, ok := logged[txID]
+		if ok {
+			decision := entry.decision
+			if decision == decisionPending && !opts.DryRun {
+				decision, claimErr = s.claimAbort(ctx, txID)
+			}
+			commit = decision == decisionCommit
+		} else {
+			commit = len(group) == group[0].participants
+		}
+
+		resolved := true
+		for _, x := range group {
+			a := RecoveryAction{TransactionID: txID, ShardID: x.shardID, GID: x.gid, Prepared: x.prepared, Commit: commit}
+			if claimErr != nil {
+				a.Err = claimErr
+				resolved = false
+			} else if !opts.DryRun {
+				stmt := "ROLLBACK PREPARED "
+				if commit {
+					stmt = "COMMIT PREPARED "
+				}
+				if _, a.Err = x.pool.Exec(ctx, stmt+quoteLiteral(x.gid)); a.Err != nil {
+					resolved = false
+				}
+			}
+			report.Actions = append(report.Actions, a)
+		}
+
+		// A participant is resolved once its shard was scanned: its prepared
+		// transaction, if any, was found and resolved above.
+		for _, id := range entry.participants {
+			if !scanned[id] {
+				resolved = false
+			}
+		}
+		if ok && resolved && !opts.DryRun {
+			coordinator.Exec(ctx, `DELETE FROM `+coordinatorTable+` WHERE id = $1`, txID)
+		}
+	}
+
+	if scanErr != nil {
+		return report, scanErr
+	}
+	return report, nil
+}
+
+// scanPrepared returns the prepared transactions of distributed transactions
+// on every shard, and the IDs of the shards scanned successfully.
+func (s *ShardManager) scanPrepared(ctx context.Context) ([]preparedXact, map[string]bool, error) {
+	shards := s.allShards()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		xacts   []preparedXact
+		scanned = make(map[string]bool)
+		me      = &MultiShardError{Shards: len(shards)}
+	)
+	for _, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			found, err := scanShardPrepared(ctx, shard.pool)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				me.Errors = append(me.Errors, &ShardError{ShardID: shard.id, Err: err})
+				return
+			}
+			scanned[shard.id] = true
+			xacts = append(xacts, found...)
+		}()
+	}
+	wg.Wait()
+
+	if len(me.Errors) > 0 {
+		return xacts, scanned, me
+	}
+	return xacts, scanned, nil
+}
+
+// scanShardPrepared returns the prepared transactions of distributed
+// transactions in the database of pool.
+func scanShardPrepared(ctx context.Context, pool *pgxpool.Pool) ([]preparedXact, error) {
+	rows, err := pool.Query(ctx, `SELECT gid, prepared, extract(epoch FROM now() - prepared)::float8
+		FROM pg_prepared_xacts
+		WHERE database = current_database() AND starts_with(gid, $1)`, gidPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		xacts    []preparedXact
+		gid      string
+		prepared time.Time
+		age      float64
+	)
+	_, err = pgx.ForEachRow(rows, []any{&gid, &prepared, &age}, func() error {
+		txID, participants, shardID, ok := parseGID(gid)
+		if !ok {
+			return nil
+		}
+		xacts = append(xacts, preparedXact{
+			pool:         pool,
+			gid:          gid,
+			txID:         txID,
+			participants: participants,
+			shardID:      shardID,
+			prepared:     prepared,
+			age:          time.Duration(age * float64(time.Second)),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return xacts, nil
+}
+
+// parseGID parses a global transaction ID of the form
+// "pgxshard:<transaction ID>:<number of participants>:<shard ID>".
+func parseGID(gid string) (txID string, participants int, shardID string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(gid, gidPrefix), ":", 3)
+	if len(parts) != 3 {
+		return "", 0, "", false
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n <= 0 {
+		return "", 0, "", false
+	}
+	return parts[0], n, parts[2], true
+}
+
+// claimAbort records the abort decision of a distributed transaction unless
+// its coordinator recorded a decision meanwhile, and returns the decision in
+// effect.
+func (s *ShardManager) claimAbort(ctx context.Context, id string) (string, error) {
+	coordinator, err := s.coordinatorPool()
+	if err != nil {
+		return "", err
+	}
+
+	tag, err := coordinator.Exec(ctx, `UPDATE `+coordinatorTable+` SET decision = $2, updated_at = now()
+		WHERE id = $1 AND decision = $3`, id, decisionAbort, decisionPending)
+	if err != nil {
+		return "", fmt.Errorf("failed to abort distributed transaction %s: %w", id, err)
+	}
+	if tag.RowsAffected() == 1 {
+		return decisionAbort, nil
+	}
+
+	var decision string
+	err = coordinator.QueryRow(ctx, `SELECT decision FROM `+coordinatorTable+` WHERE id = $1`, id).Scan(&decision)
+	if err != nil {
+		return "", fmt.Errorf("failed to read decision of distributed transaction %s: %w", id, err)
+	}
+	return decision, nil
+}
+
+// loggedTransactions returns the coordinator log entries of the distributed
+// transactions with the provided IDs.
+func loggedTransactions(ctx context.Context, coordinator *pgxpool.Pool, ids []string) (map[string]loggedTx, error) {
+	logged := make(map[string]loggedTx)
+	if len(ids) == 0 {
+		return logged, nil
+	}
+
+	rows, err := coordinator.Query(ctx, `SELECT id, participants, decision FROM `+coordinatorTable+` WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		id           string
+		participants []string
+		decision     string
+	)
+	_, err = pgx.ForEachRow(rows, []any{&id, &participants, &decision}, func() error {
+		logged[id] = loggedTx{participants: participants, decision: decision}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logged, nil
+}
@@ -0,0 +1,41 @@
+package pgxshard
+
+import "testing"
+
+func TestParseGID(t *testing.T) {
+	tests := []struct {
+		gid          string
+		txID         string
+		participants int
+		shardID      string
+		ok           bool
+	}{
+		{"pgxshard:0a1b:2:eu-1", "0a1b", 2, "eu-1", true},
+		{"pgxshard:0a1b:1:shard:with:colons", "0a1b", 1, "shard:with:colons", true},
+		{"pgxshard:0a1b:2:", "0a1b", 2, "", true},
+		{"pgxshard:0a1b:0:eu-1", "", 0, "", false},
+		{"pgxshard:0a1b:-1:eu-1", "", 0, "", false},
+		{"pgxshard:0a1b:x:eu-1", "", 0, "", false},
+		{"pgxshard:0a1b:2", "", 0, "", false},
+		{"pgxshard:", "", 0, "", false},
+	}
+	for _, tt := range tests {
+		txID, participants, shardID, ok := parseGID(tt.gid)
+		if txID != tt.txID || participants != tt.participants || shardID != tt.shardID || ok != tt.ok {
+			t.Errorf("parseGID(%q) = %q, %d, %q, %t, want %q, %d, %q, %t",
+				tt.gid, txID, participants, shardID, ok, tt.txID, tt.participants, tt.shardID, tt.ok)
+		}
+	}
+}
+
+func TestGIDRoundTrip(t *testing.T) {
+	d := &DistributedTx{id: "0123456789abcdef0123456789abcdef"}
+	d.participants = []*participant{{shardID: "eu-1"}, {shardID: "us:2"}}
+
+	for _, p := range d.participants {
+		txID, participants, shardID, ok := parseGID(d.gid(p))
+		if !ok || txID != d.id || participants != 2 || shardID != p.shardID {
+			t.Errorf("parseGID(%q) = %q, %d, %q, %t", d.gid(p), txID, participants, shardID, ok)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package pgxshard
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RendezvousHash is a shard index strategy implementing Highest Random Weight
+// hashing. Every shard is scored against the key and the shard with the
+// highest score wins, so adding or removing a shard only moves the keys won or
+// lost by that shard. Lookups cost O(numShards).
+//
+// Supported key types are the Key types and ShardKey implementations. The
+// shard returned for a given key and shard count is stable across versions of
+// this module within the same major version.
+func RendezvousHash(key any, numShards int) (int, error) {
+	if numShards <= 0 {
+		return 0, fmt.Errorf("invalid number of shards %d", numShards)
+	}
+
+	b, err := keyBytes(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return rendezvous(b, indexNodes(numShards)), nil
+}
+
+// RendezvousHashShardID is the shard ID variant of RendezvousHash. Shards are
+// scored by ID, so keys are routed independently of the order of ids.
+func RendezvousHashShardID(key any, ids []string) (string, error) {
+	if len(ids) == 0 {
+		return "", errors.New("no shards")
+	}
+
+	b, err := keyBytes(key)
+	if err != nil {
+		return "", err
+	}
+
+	return ids[rendezvous(b, ids)], nil
+}
+
+// rendezvous returns the position of the node with the highest score for the
+// encoded key.
+func rendezvous(key []byte, nodes []string) int {
+	best, bestScore := 0, uint64(0)
+	buf := make([]byte, 0, 32+len(key))
+	for i, node := range nodes {
+		buf = append(buf[:0], node...)
+		buf = append(buf, 0)
+		buf = append(buf, key...)
+		if score := hash64(buf); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,45 @@
+package pgxshard
+
+import "testing"
+
+func TestRendezvousHash(t *testing.T) {
+	for _, v := range hashVectors {
+		got, err := RendezvousHash(v.key, 16)
+		if err != nil {
+			t.Fatalf("RendezvousHash(%#v): %v", v.key, err)
+		}
+		if got != v.rendezvous {
+			t.Errorf("RendezvousHash(%#v, 16) = %d, want %d", v.key, got, v.rendezvous)
+		}
+	}
+}
+
+func TestRendezvousHashShardID(t *testing.T) {
+	reversed := []string{"us-2", "us-1", "eu-2", "eu-1"}
+	for _, v := range hashVectors {
+		got, err := RendezvousHashShardID(v.key, vectorShardIDs)
+		if err != nil {
+			t.Fatalf("RendezvousHashShardID(%#v): %v", v.key, err)
+		}
+		if got != v.rendezvousID {
+			t.Errorf("RendezvousHashShardID(%#v) = %q, want %q", v.key, got, v.rendezvousID)
+		}
+
+		// Shards are scored by ID, so their order does not matter.
+		got, err = RendezvousHashShardID(v.key, reversed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v.rendezvousID {
+			t.Errorf("RendezvousHashShardID(%#v) over reversed IDs = %q, want %q", v.key, got, v.rendezvousID)
+		}
+	}
+}
+
+func TestRendezvousHashMovement(t *testing.T) {
+	for key, shard := range checkMovement(t, RendezvousHash) {
+		if shard != 8 {
+			t.Fatalf("key %d moved to shard %d, want the new shard 8", key, shard)
+		}
+	}
+}
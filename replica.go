@@ -0,0 +1,164 @@
+package pgxshard
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ReplicaBalancer selects the replica serving a read among the available
+// replicas of a shard.
+type ReplicaBalancer int
+
+const (
+	// BalanceRoundRobin rotates reads over the replicas.
+	BalanceRoundRobin ReplicaBalancer = iota
+	// BalanceLeastConnections sends reads to the replica with the fewest
+	// acquired connections.
+	BalanceLeastConnections
+	// BalanceLatency sends reads to the replica with the lowest ping latency
+	// measured by Health, and rotates over the replicas until every replica
+	// has been measured.
+	BalanceLatency
+)
+
+// String returns the name of the balancer.
+func (b ReplicaBalancer) String() string {
+	switch b {
+	case BalanceLeastConnections:
+		return "least-connections"
+	case BalanceLatency:
+		return "latency"
+	}
+	return "round-robin"
+}
+
+// replica is a read replica of a shard.
+type replica struct {
+	id   string
+	pool *pgxpool.Pool
+	// latency is the moving average of the ping latency in nanoseconds.
+	latency atomic.Int64
+	// replayLSN is the last known WAL position replayed by the replica.
+	replayLSN atomic.Uint64
+	// lag is the last measured replication lag in bytes.
+	lag atomic.Int64
+}
+
+// observe records a ping latency of the replica.
+func (r *replica) observe(d time.Duration) {
+	for {
+		old := r.latency.Load()
+		avg := int64(d)
+		if old > 0 {
+			avg = (old*4 + int64(d)) / 5
+		}
+		if r.latency.CompareAndSwap(old, avg) {
+			return
+		}
+	}
+}
+
+// replicaSet holds the read replicas of a shard.
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+}
+
+// replicaID returns the ID identifying the i-th replica of a shard in health
+// reports and state changes.
+func replicaID(shardID string, i int) string {
+	return fmt.Sprintf("%s/replica-%d", shardID, i)
+}
+
+// pick returns a replica among candidates according to b.
+func (rs *replicaSet) pick(b ReplicaBalancer, candidates []*replica) *replica {
+	switch b {
+	case BalanceLeastConnections:
+		best := candidates[0]
+		bestConns := best.pool.Stat().AcquiredConns()
+		for _, r := range candidates[1:] {
+			if conns := r.pool.Stat().AcquiredConns(); conns < bestConns {
+				best, bestConns = r, conns
+			}
+		}
+		return best
+
+	case BalanceLatency:
+		var best *replica
+		for _, r := range candidates {
+			latency := r.latency.Load()
+			if latency == 0 {
+				best = nil
+				break
+			}
+			if best == nil || latency < best.latency.Load() {
+				best = r
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+
+	return candidates[rs.next.Add(1)%uint64(len(candidates))]
+}
+
+// ShardForRead returns the database pool reads for the provided key should be
+// served from. It picks one of the available replicas of the key's shard with
+// the configured replica balancer, and falls back to the primary if the shard
+// has no available replica. During a topology transition, the shard is the
+// one reads are served from in the current phase.
+//
+// Replicas and primaries quarantined by the health checker are skipped; if
+// neither is available, it returns a *ShardUnavailableError. Replicas lagging
+// more than the configured maximum replica lag are skipped, and if ctx carries
+// a SessionToken, only replicas that have replayed the session's last write
+// on the shard are used.
+func (s *ShardManager) ShardForRead(ctx context.Context, key any) (*pgxpool.Pool, error) {
+	t, index, err := s.locate(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	balancer, maxLag := s.replicaBalancer, s.maxReplicaLag
+	var candidates []*replica
+	for _, r := range t.replicas[index].replicas {
+		if s.unhealthy[r.id] || (maxLag > 0 && r.lag.Load() > maxLag) {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+	s.mu.RUnlock()
+
+	if token, ok := SessionTokenFromContext(ctx); ok && len(candidates) > 0 {
+		if lsn := token.LSN(t.ids[index]); lsn > 0 {
+			candidates = caughtUp(ctx, candidates, lsn)
+		}
+	}
+
+	if len(candidates) > 0 {
+		return t.replicas[index].pick(balancer, candidates).pool, nil
+	}
+
+	if err := s.checkAvailable(t.ids[index]); err != nil {
+		return nil, err
+	}
+	return t.pools[index], nil
+}
+
+// ShardForWrite returns the primary database pool of the shard writes for the
+// provided key go to. During a topology transition, it returns an error
+// matching ErrTransitionInProgress for keys that move between shards, whose
+// writes must go to every shard returned by ShardsForWrite.
+func (s *ShardManager) ShardForWrite(ctx context.Context, key any) (*pgxpool.Pool, error) {
+	t, index, err := s.locateWrite(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return t.pools[index], nil
+}
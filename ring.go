@@ -0,0 +1,170 @@
+package pgxshard
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultVirtualNodes is the number of virtual nodes placed on the ring for a
+// shard with weight 1 when NewConsistentHash is given a non-positive count.
+const DefaultVirtualNodes = 160
+
+// ConsistentHash is a shard index strategy that places every shard on a hash
+// ring using virtual nodes. Changing the number of shards only remaps the keys
+// owned by the ring points that were added or removed, so growing from n to
+// n+1 shards moves roughly 1/(n+1) of the keys.
+//
+// Supported key types are the Key types and ShardKey implementations. The
+// ring layout for a given shard count, weights and virtual node count is
+// stable across versions of this module within the same major version.
+//
+// Its ShardIndex method can be installed with ShardManager.SetShardIndexFunc
+// or WithShardIndexFunc, and its ShardID method with
+// ShardManager.SetShardIDFunc or WithShardIDFunc.
+type ConsistentHash struct {
+	mu           sync.Mutex
+	virtualNodes int
+	weights      map[string]int
+	rings        map[string]*hashRing
+}
+
+// NewConsistentHash creates a ConsistentHash placing virtualNodes points on
+// the ring for every unit of shard weight.
+func NewConsistentHash(virtualNodes int) *ConsistentHash {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+
+	return &ConsistentHash{
+		virtualNodes: virtualNodes,
+		weights:      make(map[string]int),
+		rings:        make(map[string]*hashRing),
+	}
+}
+
+// SetWeight sets the relative weight of the shard at the given index. Shards
+// default to a weight of 1; a weight of 0 removes the shard from the ring.
+func (c *ConsistentHash) SetWeight(shard int, weight int) {
+	c.setWeight(strconv.Itoa(shard), weight)
+}
+
+// SetShardIDWeight sets the relative weight of the shard with the given ID,
+// see SetWeight.
+func (c *ConsistentHash) SetShardIDWeight(id string, weight int) {
+	c.setWeight(id, weight)
+}
+
+func (c *ConsistentHash) setWeight(node string, weight int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if weight < 0 {
+		weight = 0
+	}
+	c.weights[node] = weight
+	c.rings = make(map[string]*hashRing)
+}
+
+// ShardIndex returns the index of the shard owning key on a ring built for
+// numShards shards.
+func (c *ConsistentHash) ShardIndex(key any, numShards int) (int, error) {
+	h, err := hashKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := c.ring(indexNodes(numShards))
+	if err != nil {
+		return 0, err
+	}
+
+	return r.locate(h), nil
+}
+
+// ShardID returns the ID of the shard owning key on a ring built for the
+// shards with the given IDs. Keys are routed independently of the order of
+// ids.
+func (c *ConsistentHash) ShardID(key any, ids []string) (string, error) {
+	h, err := hashKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	nodes := append([]string(nil), ids...)
+	sort.Strings(nodes)
+
+	r, err := c.ring(nodes)
+	if err != nil {
+		return "", err
+	}
+
+	return nodes[r.locate(h)], nil
+}
+
+// ring returns the ring for the given nodes, building and caching it on first
+// use.
+func (c *ConsistentHash) ring(nodes []string) (*hashRing, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := strings.Join(nodes, "\x00")
+	if r, ok := c.rings[k]; ok {
+		return r, nil
+	}
+
+	r := &hashRing{}
+	for i, node := range nodes {
+		weight, ok := c.weights[node]
+		if !ok {
+			weight = 1
+		}
+		for v := 0; v < weight*c.virtualNodes; v++ {
+			r.points = append(r.points, ringPoint{
+				hash: hash64([]byte(node + "#" + strconv.Itoa(v))),
+				node: i,
+			})
+		}
+	}
+	if len(r.points) == 0 {
+		return nil, errors.New("consistent hash ring has no shards")
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	c.rings[k] = r
+	return r, nil
+}
+
+// indexNodes returns the ring node names of numShards shards identified by
+// their index.
+func indexNodes(numShards int) []string {
+	nodes := make([]string, numShards)
+	for i := range nodes {
+		nodes[i] = strconv.Itoa(i)
+	}
+	return nodes
+}
+
+type ringPoint struct {
+	hash uint64
+	node int
+}
+
+type hashRing struct {
+	points []ringPoint
+}
+
+// locate returns the node owning the first ring point at or after h.
+func (r *hashRing) locate(h uint64) int {
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
@@ -0,0 +1,37 @@
+package pgxshard
+
+import "testing"
+
+func TestConsistentHash(t *testing.T) {
+	c := NewConsistentHash(0)
+	for _, v := range hashVectors {
+		got, err := c.ShardIndex(v.key, 16)
+		if err != nil {
+			t.Fatalf("ShardIndex(%#v): %v", v.key, err)
+		}
+		if got != v.ring {
+			t.Errorf("ShardIndex(%#v, 16) = %d, want %d", v.key, got, v.ring)
+		}
+	}
+}
+
+func TestConsistentHashShardID(t *testing.T) {
+	c := NewConsistentHash(0)
+	for _, v := range hashVectors {
+		got, err := c.ShardID(v.key, vectorShardIDs)
+		if err != nil {
+			t.Fatalf("ShardID(%#v): %v", v.key, err)
+		}
+		if got != v.ringID {
+			t.Errorf("ShardID(%#v) = %q, want %q", v.key, got, v.ringID)
+		}
+	}
+}
+
+func TestConsistentHashMovement(t *testing.T) {
+	for key, shard := range checkMovement(t, NewConsistentHash(0).ShardIndex) {
+		if shard != 8 {
+			t.Fatalf("key %d moved to shard %d, want the new shard 8", key, shard)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package pgxshard
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Router is a typed view of a ShardManager routing keys of type K only, so
+// that keys of an unsupported type are rejected at compile time. It is created
+// with NewRouter for the Key types and NewShardKeyRouter for ShardKey
+// implementations.
+//
+// A custom shard index function must support K for routing to succeed. Every
+// strategy of this package supports every K except RangeShardMap, which
+// rejects [16]byte and ShardKey keys as they have no meaningful order.
+type Router[K any] struct {
+	s *ShardManager
+}
+
+// NewRouter returns a Router for keys of one of the Key types.
+func NewRouter[K Key](s *ShardManager) *Router[K] {
+	return &Router[K]{s: s}
+}
+
+// NewShardKeyRouter returns a Router for keys hashing themselves.
+func NewShardKeyRouter[K ShardKey](s *ShardManager) *Router[K] {
+	return &Router[K]{s: s}
+}
+
+// ShardManager returns the ShardManager of the router.
+func (r *Router[K]) ShardManager() *ShardManager {
+	return r.s
+}
+
+// Shard returns the shard corresponding to the provided key.
+func (r *Router[K]) Shard(ctx context.Context, key K) (*pgxpool.Pool, error) {
+	return r.s.Shard(ctx, key)
+}
+
+// ShardForRead returns a pool to read the rows of key from. See
+// ShardManager.ShardForRead.
+func (r *Router[K]) ShardForRead(ctx context.Context, key K) (*pgxpool.Pool, error) {
+	return r.s.ShardForRead(ctx, key)
+}
+
+// ShardID returns the ID of the shard corresponding to the provided key.
+func (r *Router[K]) ShardID(ctx context.Context, key K) (string, error) {
+	return r.s.ShardID(ctx, key)
+}
+
+// ShardForWrite returns the primary pool of the shard writes for key go to.
+// See ShardManager.ShardForWrite.
+func (r *Router[K]) ShardForWrite(ctx context.Context, key K) (*pgxpool.Pool, error) {
+	return r.s.ShardForWrite(ctx, key)
+}
+
+// ShardsForWrite returns the pools writes for key must go to in the current
+// transition phase. See ShardManager.ShardsForWrite.
+func (r *Router[K]) ShardsForWrite(ctx context.Context, key K) ([]*pgxpool.Pool, error) {
+	return r.s.ShardsForWrite(ctx, key)
+}
+
+// GroupByShard groups keys by the index of their shard, keeping the order of
+// keys within each group.
+func (r *Router[K]) GroupByShard(ctx context.Context, keys []K) (map[int][]K, error) {
+	t, indexFunc, idFunc := r.s.routing()
+	return groupKeys(ctx, t, indexFunc, idFunc, keys)
+}
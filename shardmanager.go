@@ -2,113 +2,464 @@ package pgxshard
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"hash/crc32"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// ShardIndexFunc calculates the shard index for the provided key given the
+// number of shards.
+type ShardIndexFunc func(key any, numShards int) (int, error)
+
+// ShardIndexContextFunc is a ShardIndexFunc that also receives the context of
+// the lookup, for strategies that need to query a database or another service.
+type ShardIndexContextFunc func(ctx context.Context, key any, numShards int) (int, error)
+
+// withContext adapts f to a ShardIndexContextFunc.
+func (f ShardIndexFunc) withContext() ShardIndexContextFunc {
+	return func(ctx context.Context, key any, numShards int) (int, error) {
+		return f(key, numShards)
+	}
+}
+
+// ShardIDFunc returns the ID of the shard for the provided key given the IDs of
+// all shards. Unlike a ShardIndexFunc, it routes keys independently of the
+// order in which the shards were defined.
+type ShardIDFunc func(key any, ids []string) (string, error)
+
 // defaultShardIndexFunc is the default function used to calculate the shard index
 // based on the provided key and the number of shards.
-var defaultShardIndexFunc = func(key any, numShards int) (int, error) {
+var defaultShardIndexFunc ShardIndexFunc = defaultShardIndex
+
+// defaultShardIndex implements defaultShardIndexFunc: integer keys are taken
+// modulo numShards, other keys are hashed with CRC-32 first.
+func defaultShardIndex(key any, numShards int) (int, error) {
 	switch v := key.(type) {
+	case CompositeKey:
+		if len(v) == 1 {
+			return defaultShardIndex(v[0], numShards)
+		}
+		h, err := compositeHash(v)
+		if err != nil {
+			return 0, err
+		}
+		return int(h % uint64(numShards)), nil
+	case ShardKey:
+		return int(v.ShardHash() % uint64(numShards)), nil
 	case int:
 		return v % numShards, nil
 	case int32:
 		return int(v) % numShards, nil
 	case int64:
 		return int(v) % numShards, nil
+	case uint64:
+		return int(v % uint64(numShards)), nil
 	case string:
 		return int(crc32.ChecksumIEEE([]byte(v))) % numShards, nil
+	case []byte:
+		return int(crc32.ChecksumIEEE(v)) % numShards, nil
+	case [16]byte:
+		return int(crc32.ChecksumIEEE(v[:])) % numShards, nil
+	}
+
+	if n, ok := normalizeKey(key); ok {
+		return defaultShardIndex(n, numShards)
 	}
+	return 0, errKeyTypeNotSupported
+}
 
-	return 0, errors.New("shard key type not supported")
+// ShardConfig defines a shard identified by a stable ID.
+type ShardConfig struct {
+	ID         string
+	ConnString string
+	// Replicas are the connection strings of the read replicas of the shard.
+	Replicas []string
+	// Hosts are candidate "host" or "host:port" addresses of the primary. If
+	// set, the shard connects to the candidate that is not in recovery,
+	// using ConnString for everything but the host, and reconnects to the new
+	// primary after a failover.
+	Hosts []string
 }
 
 // ShardManager manages a set of database shards and provides methods to interact with them.
 type ShardManager struct {
-	mu             sync.Mutex
-	shards         []*pgxpool.Pool
-	numShards      int
-	shardIndexFunc func(key any, numShards int) (int, error)
+	mu              sync.RWMutex
+	topo            *topology
+	next            *topology
+	phase           TransitionPhase
+	shardIndexFunc  ShardIndexContextFunc
+	shardIDFunc     ShardIDFunc
+	subscribers     map[int]func(Topology)
+	nextSubscriber  int
+	maxParallelism  int
+	failurePolicy   FailurePolicy
+	healthTimeout   time.Duration
+	replicaBalancer ReplicaBalancer
+	maxReplicaLag   int64
+
+	unhealthy         map[string]bool
+	stopHealthChecker func()
+
+	failoverHandler func(FailoverEvent)
+	primaryChecks   sync.Map
+
+	coordinator     *pgxpool.Pool
+	stopOutboxRelay func()
+	stopLagTracker  func()
+
+	// topoMu serializes topology changes, which open connections outside mu.
+	topoMu sync.Mutex
+}
+
+// Option configures a ShardManager created by New or NewWithConfig.
+type Option func(*ShardManager)
+
+// WithShardIndexFunc sets the shard index function used by the ShardManager
+// instead of the default one.
+func WithShardIndexFunc(f ShardIndexFunc) Option {
+	return func(s *ShardManager) {
+		s.shardIndexFunc = f.withContext()
+		s.shardIDFunc = nil
+	}
+}
+
+// WithShardIndexContextFunc sets the context-aware shard index function used
+// by the ShardManager instead of the default one.
+func WithShardIndexContextFunc(f ShardIndexContextFunc) Option {
+	return func(s *ShardManager) {
+		s.shardIndexFunc = f
+		s.shardIDFunc = nil
+	}
+}
+
+// WithShardIDFunc sets the shard ID function used by the ShardManager instead
+// of the default shard index function.
+func WithShardIDFunc(f ShardIDFunc) Option {
+	return func(s *ShardManager) {
+		s.shardIDFunc = f
+	}
+}
+
+// WithMaxParallelism limits the number of shards queried concurrently by
+// operations that run on all shards. A non-positive n removes the limit.
+func WithMaxParallelism(n int) Option {
+	return func(s *ShardManager) {
+		s.maxParallelism = n
+	}
+}
+
+// WithFailurePolicy sets the failure policy of operations that run on all
+// shards. The default policy is FailFast.
+func WithFailurePolicy(p FailurePolicy) Option {
+	return func(s *ShardManager) {
+		s.failurePolicy = p
+	}
+}
+
+// WithHealthTimeout sets the timeout of the health check of each shard
+// performed by Health. The default is DefaultHealthTimeout.
+func WithHealthTimeout(d time.Duration) Option {
+	return func(s *ShardManager) {
+		s.healthTimeout = d
+	}
+}
+
+// WithReplicaBalancer sets the balancer selecting the replica that serves a
+// read in ShardForRead. The default is BalanceRoundRobin.
+func WithReplicaBalancer(b ReplicaBalancer) Option {
+	return func(s *ShardManager) {
+		s.replicaBalancer = b
+	}
+}
+
+// WithMaxReplicaLag excludes replicas lagging more than maxLag bytes of WAL
+// behind their primary from ShardForRead. The lag is measured every second in
+// the background, and by Health. A non-positive maxLag removes the limit.
+func WithMaxReplicaLag(maxLag int64) Option {
+	return func(s *ShardManager) {
+		s.maxReplicaLag = maxLag
+	}
+}
+
+// WithFailoverHandler sets a function called whenever a shard reconnects to a
+// new primary.
+func WithFailoverHandler(f func(FailoverEvent)) Option {
+	return func(s *ShardManager) {
+		s.failoverHandler = f
+	}
+}
+
+// WithCoordinatorPool sets the pool holding the coordinator log of
+// distributed transactions.
+func WithCoordinatorPool(pool *pgxpool.Pool) Option {
+	return func(s *ShardManager) {
+		s.coordinator = pool
+	}
 }
 
 // New creates a new ShardManager instance by initializing connections to the provided
 // database connection strings. It returns an error if any connection fails.
-func New(ctx context.Context, connectionStrings []string) (*ShardManager, error) {
-	shards := make([]*pgxpool.Pool, len(connectionStrings))
-
+//
+// Shards created by New are identified by their position in connectionStrings,
+// so their IDs are "0", "1" and so on, and keys are routed by position with
+// the default shard index function.
+func New(ctx context.Context, connectionStrings []string, opts ...Option) (*ShardManager, error) {
+	shards := make([]ShardConfig, len(connectionStrings))
 	for i, connStr := range connectionStrings {
-		db, err := pgxpool.New(ctx, connStr)
-		if err != nil {
-			return nil, fmt.Errorf("failed to connect to shard %d: %v", i, err)
-		}
-		shards[i] = db
+		shards[i] = ShardConfig{ID: strconv.Itoa(i), ConnString: connStr}
 	}
 
-	return &ShardManager{
-		shards:         shards,
-		numShards:      len(shards),
-		shardIndexFunc: defaultShardIndexFunc,
-	}, nil
+	opts = append([]Option{WithShardIndexFunc(defaultShardIndexFunc)}, opts...)
+	return NewWithConfig(ctx, shards, opts...)
+}
+
+// NewWithConfig creates a new ShardManager instance from named shard definitions.
+// Shard IDs must be unique and non-empty. It returns an error if any connection fails.
+//
+// Keys are routed by shard ID with RendezvousHashShardID unless another
+// strategy is set, so reordering shards does not reroute data.
+func NewWithConfig(ctx context.Context, shards []ShardConfig, opts ...Option) (*ShardManager, error) {
+	topo, _, err := buildTopology(ctx, shards, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ShardManager{
+		topo:           topo,
+		shardIndexFunc: defaultShardIndexFunc.withContext(),
+		shardIDFunc:    RendezvousHashShardID,
+		subscribers:    make(map[int]func(Topology)),
+		healthTimeout:  DefaultHealthTimeout,
+		unhealthy:      make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.mu.Lock()
+	s.updateLagTracker()
+	s.mu.Unlock()
+
+	return s, nil
 }
 
 // SetShardIndexFunc sets a custom shard index function to determine which shard
 // to use based on the provided key.
-func (s *ShardManager) SetShardIndexFunc(ctx context.Context, f func(key any, count int) (int, error)) {
+func (s *ShardManager) SetShardIndexFunc(ctx context.Context, f ShardIndexFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shardIndexFunc = f.withContext()
+	s.shardIDFunc = nil
+}
+
+// SetShardIndexContextFunc sets a custom context-aware shard index function to
+// determine which shard to use based on the provided key.
+func (s *ShardManager) SetShardIndexContextFunc(ctx context.Context, f ShardIndexContextFunc) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.shardIndexFunc = f
+	s.shardIDFunc = nil
+}
+
+// SetShardIDFunc sets a custom shard ID function to determine which shard to use
+// based on the provided key. It replaces any shard index function.
+func (s *ShardManager) SetShardIDFunc(ctx context.Context, f ShardIDFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shardIDFunc = f
+}
+
+// SetMaxParallelism limits the number of shards queried concurrently by
+// operations that run on all shards. A non-positive n removes the limit.
+func (s *ShardManager) SetMaxParallelism(ctx context.Context, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxParallelism = n
+}
+
+// SetFailurePolicy sets the failure policy of operations that run on all
+// shards.
+func (s *ShardManager) SetFailurePolicy(ctx context.Context, p FailurePolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failurePolicy = p
+}
+
+// SetHealthTimeout sets the timeout of the health check of each shard
+// performed by Health.
+func (s *ShardManager) SetHealthTimeout(ctx context.Context, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthTimeout = d
+}
+
+// SetReplicaBalancer sets the balancer selecting the replica that serves a
+// read in ShardForRead.
+func (s *ShardManager) SetReplicaBalancer(ctx context.Context, b ReplicaBalancer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replicaBalancer = b
+}
+
+// SetMaxReplicaLag excludes replicas lagging more than maxLag bytes of WAL
+// behind their primary from ShardForRead. See WithMaxReplicaLag.
+func (s *ShardManager) SetMaxReplicaLag(ctx context.Context, maxLag int64) {
+	s.mu.Lock()
+	s.maxReplicaLag = maxLag
+	stop := s.updateLagTracker()
+	s.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
 }
 
 // Shard returns the database shard corresponding to the provided key.
 // It uses the shard index function to determine the appropriate shard.
+// If the shard is quarantined by the health checker, it returns a
+// *ShardUnavailableError.
+//
+// Shard routes like reads: during a topology transition, it returns the shard
+// reads are served from in the current phase. Writes must then go through
+// ShardsForWrite or ShardForWrite, or they miss the other shard of moving
+// keys and are lost if the transition is aborted.
 func (s *ShardManager) Shard(ctx context.Context, key any) (*pgxpool.Pool, error) {
-	index, err := s.shardIndexFunc(key, s.numShards)
+	t, index, err := s.locate(ctx, key)
 	if err != nil {
 		return nil, err
 	}
 
-	if index < 0 || index > len(s.shards)-1 {
-		return nil, fmt.Errorf("shard index %d is out of range", index)
+	if err := s.checkAvailable(t.ids[index]); err != nil {
+		return nil, err
 	}
 
-	return s.shards[index], nil
+	return t.pools[index], nil
 }
 
-// Shards returns all the database shards managed by the ShardManager.
-func (s *ShardManager) Shards(ctx context.Context) ([]*pgxpool.Pool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// ShardID returns the ID of the shard corresponding to the provided key.
+func (s *ShardManager) ShardID(ctx context.Context, key any) (string, error) {
+	t, index, err := s.locate(ctx, key)
+	if err != nil {
+		return "", err
+	}
 
-	return s.shards, nil
+	return t.ids[index], nil
 }
 
-// Ping checks the connectivity of all shards by pinging each one.
-// It returns an error if any shard is unreachable.
-func (s *ShardManager) Ping(ctx context.Context) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// ShardByID returns the database shard with the provided ID. During a
+// topology transition, shards of both the old and the new layout are found.
+func (s *ShardManager) ShardByID(ctx context.Context, id string) (*pgxpool.Pool, error) {
+	s.mu.RLock()
+	t, next := s.topo, s.next
+	s.mu.RUnlock()
 
-	for _, shard := range s.shards {
-		if err := shard.Ping(ctx); err != nil {
-			return err
+	if index, ok := t.indexes[id]; ok {
+		return t.pools[index], nil
+	}
+	if next != nil {
+		if index, ok := next.indexes[id]; ok {
+			return next.pools[index], nil
 		}
 	}
 
-	return nil
+	return nil, fmt.Errorf("shard %q not found", id)
+}
+
+// ShardIDs returns the IDs of all shards in the order of Shards.
+func (s *ShardManager) ShardIDs(ctx context.Context) []string {
+	return append([]string(nil), s.topology().ids...)
 }
 
-// Close closes all the database connections managed by the ShardManager.
+// Shards returns all the database shards managed by the ShardManager.
+func (s *ShardManager) Shards(ctx context.Context) ([]*pgxpool.Pool, error) {
+	return append([]*pgxpool.Pool(nil), s.topology().pools...), nil
+}
+
+// Ping checks the connectivity of all shards by pinging each one concurrently.
+// It returns a *MultiShardError listing the unreachable shards if the failure
+// policy is not satisfied.
+func (s *ShardManager) Ping(ctx context.Context) error {
+	t := s.readTopology()
+
+	_, err := s.forEachShard(ctx, t, func(ctx context.Context, i int) error {
+		return t.pools[i].Ping(ctx)
+	})
+	return err
+}
+
+// Close stops the background workers and closes all the database
+// connections managed by the ShardManager.
 func (s *ShardManager) Close(ctx context.Context) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.StopHealthChecker(ctx)
+	s.StopOutboxRelay(ctx)
+	s.stopLagTracking()
 
-	for _, shard := range s.shards {
-		shard.Close()
+	s.mu.RLock()
+	t, next := s.topo, s.next
+	s.mu.RUnlock()
+
+	closePools(t.allPools())
+	if next != nil {
+		closePools(next.unshared(t))
 	}
 
 	return nil
 }
+
+// topology returns the current topology.
+func (s *ShardManager) topology() *topology {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.topo
+}
+
+// readTopology returns the topology reads are served from, which differs from
+// the current topology in PhaseReadNew.
+func (s *ShardManager) readTopology() *topology {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.phase == PhaseReadNew {
+		return s.next
+	}
+	return s.topo
+}
+
+// locate returns the topology reads are served from and the index of the
+// shard for key in it, using the shard ID function if one is set, and the
+// shard index function otherwise.
+func (s *ShardManager) locate(ctx context.Context, key any) (*topology, int, error) {
+	t, indexFunc, idFunc := s.routing()
+
+	index, err := t.locate(ctx, key, indexFunc, idFunc)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return t, index, nil
+}
+
+// routing returns the topology keys are routed in, which differs from the
+// current topology in PhaseReadNew, and the shard strategy.
+func (s *ShardManager) routing() (*topology, ShardIndexContextFunc, ShardIDFunc) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t := s.topo
+	if s.phase == PhaseReadNew {
+		t = s.next
+	}
+	return t, s.shardIndexFunc, s.shardIDFunc
+}
+
+// closePools closes the provided pools.
+func closePools(pools []*pgxpool.Pool) {
+	for _, pool := range pools {
+		pool.Close()
+	}
+}
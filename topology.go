@@ -0,0 +1,406 @@
+package pgxshard
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Topology describes the shard layout of a ShardManager at a point in time.
+type Topology struct {
+	// Version is incremented on every topology change.
+	Version uint64
+	// Shards are the shard definitions in the order of ShardManager.Shards.
+	Shards []ShardConfig
+}
+
+// ShardIDs returns the IDs of the shards in the topology.
+func (t Topology) ShardIDs() []string {
+	ids := make([]string, len(t.Shards))
+	for i, shard := range t.Shards {
+		ids[i] = shard.ID
+	}
+	return ids
+}
+
+// topology is an immutable shard layout. Topology changes build a new
+// topology and swap it in under ShardManager.mu.
+type topology struct {
+	version  uint64
+	configs  []ShardConfig
+	pools    []*pgxpool.Pool
+	replicas []*replicaSet
+	ids      []string
+	indexes  map[string]int
+	// primaries are the hosts resolved as primary for shards with Hosts.
+	primaries []string
+}
+
+// buildTopology validates shards and returns a topology for them, reusing the
+// pools of prev for shards whose definition did not change. It also returns
+// the pools of prev that are no longer used.
+func buildTopology(ctx context.Context, shards []ShardConfig, prev *topology) (*topology, []*pgxpool.Pool, error) {
+	t := &topology{
+		configs:   append([]ShardConfig(nil), shards...),
+		pools:     make([]*pgxpool.Pool, len(shards)),
+		replicas:  make([]*replicaSet, len(shards)),
+		ids:       make([]string, len(shards)),
+		indexes:   make(map[string]int, len(shards)),
+		primaries: make([]string, len(shards)),
+	}
+
+	var opened []*pgxpool.Pool
+
+	for i, shard := range shards {
+		if shard.ID == "" {
+			closePools(opened)
+			return nil, nil, fmt.Errorf("shard %d has no ID", i)
+		}
+		if _, ok := t.indexes[shard.ID]; ok {
+			closePools(opened)
+			return nil, nil, fmt.Errorf("duplicate shard ID %q", shard.ID)
+		}
+		t.ids[i] = shard.ID
+		t.indexes[shard.ID] = i
+
+		if prev != nil {
+			if j, ok := prev.indexes[shard.ID]; ok && sameShardConfig(prev.configs[j], shard) {
+				t.pools[i] = prev.pools[j]
+				t.replicas[i] = prev.replicas[j]
+				t.primaries[i] = prev.primaries[j]
+				continue
+			}
+		}
+
+		db, host, err := openPrimary(ctx, shard)
+		if err != nil {
+			closePools(opened)
+			return nil, nil, fmt.Errorf("failed to connect to shard %s: %v", shard.ID, err)
+		}
+		t.pools[i] = db
+		t.primaries[i] = host
+		opened = append(opened, db)
+
+		t.replicas[i] = &replicaSet{}
+		for j, connStr := range shard.Replicas {
+			db, err := pgxpool.New(ctx, connStr)
+			if err != nil {
+				closePools(opened)
+				return nil, nil, fmt.Errorf("failed to connect to replica %d of shard %s: %v", j, shard.ID, err)
+			}
+			t.replicas[i].replicas = append(t.replicas[i].replicas, &replica{id: replicaID(shard.ID, j), pool: db})
+			opened = append(opened, db)
+		}
+	}
+
+	var removed []*pgxpool.Pool
+	if prev != nil {
+		t.version = prev.version + 1
+		removed = prev.unshared(t)
+	}
+
+	return t, removed, nil
+}
+
+// sameShardConfig reports whether a and b define the same shard.
+func sameShardConfig(a, b ShardConfig) bool {
+	return a.ID == b.ID && a.ConnString == b.ConnString &&
+		slices.Equal(a.Replicas, b.Replicas) && slices.Equal(a.Hosts, b.Hosts)
+}
+
+// allPools returns the primary and replica pools of every shard of t.
+func (t *topology) allPools() []*pgxpool.Pool {
+	pools := append([]*pgxpool.Pool(nil), t.pools...)
+	for _, rs := range t.replicas {
+		for _, r := range rs.replicas {
+			pools = append(pools, r.pool)
+		}
+	}
+	return pools
+}
+
+// unshared returns the primary and replica pools of t that are not used by
+// other.
+func (t *topology) unshared(other *topology) []*pgxpool.Pool {
+	shared := make(map[*pgxpool.Pool]bool)
+	for _, pool := range other.allPools() {
+		shared[pool] = true
+	}
+
+	var pools []*pgxpool.Pool
+	for _, pool := range t.allPools() {
+		if !shared[pool] {
+			pools = append(pools, pool)
+		}
+	}
+	return pools
+}
+
+// public returns the exported description of t.
+func (t *topology) public() Topology {
+	return Topology{
+		Version: t.version,
+		Shards:  append([]ShardConfig(nil), t.configs...),
+	}
+}
+
+// locate returns the index of the shard for key in t, using idFunc if it is
+// set, and indexFunc otherwise.
+func (t *topology) locate(ctx context.Context, key any, indexFunc ShardIndexContextFunc, idFunc ShardIDFunc) (int, error) {
+	if idFunc != nil {
+		id, err := idFunc(key, t.ids)
+		if err != nil {
+			return 0, err
+		}
+
+		index, ok := t.indexes[id]
+		if !ok {
+			return 0, fmt.Errorf("shard %q not found", id)
+		}
+		return index, nil
+	}
+
+	index, err := indexFunc(ctx, key, len(t.pools))
+	if err != nil {
+		return 0, err
+	}
+
+	if index < 0 || index > len(t.pools)-1 {
+		return 0, fmt.Errorf("shard index %d is out of range", index)
+	}
+
+	return index, nil
+}
+
+// Topology returns the current shard layout.
+func (s *ShardManager) Topology(ctx context.Context) Topology {
+	return s.topology().public()
+}
+
+// Subscribe registers f to be called with the new layout after every topology
+// change. It returns a function that removes the subscription.
+//
+// f is called once the change is complete, outside of the locks serializing
+// topology changes, so it may change the topology itself. Notifications of
+// concurrent changes may arrive out of order; Topology.Version tells which
+// layout is the latest.
+func (s *ShardManager) Subscribe(ctx context.Context, f func(Topology)) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.nextSubscriber
+	s.nextSubscriber++
+	s.subscribers[id] = f
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subscribers, id)
+	}
+}
+
+// AddShard adds a shard at the end of the shard list.
+func (s *ShardManager) AddShard(ctx context.Context, shard ShardConfig) error {
+	return s.changeTopology(ctx, func(t *topology) ([]ShardConfig, error) {
+		return append(t.public().Shards, shard), nil
+	})
+}
+
+// RemoveShard removes the shard with the provided ID. Its pool is closed once
+// the connections in use are released.
+func (s *ShardManager) RemoveShard(ctx context.Context, id string) error {
+	return s.changeTopology(ctx, func(t *topology) ([]ShardConfig, error) {
+		index, ok := t.indexes[id]
+		if !ok {
+			return nil, fmt.Errorf("shard %q not found", id)
+		}
+
+		shards := append([]ShardConfig(nil), t.configs[:index]...)
+		return append(shards, t.configs[index+1:]...), nil
+	})
+}
+
+// ReplaceTopology replaces the shard layout with the provided shards at once.
+// See BeginTransition to move to a new layout in phases instead. Pools of
+// shards whose definition is unchanged are kept; pools of
+// removed or changed shards are closed once the connections in use are
+// released.
+//
+// The new layout is swapped in atomically and subscribers are notified before
+// ReplaceTopology waits for removed pools to drain. If ctx is done while
+// waiting, the pools keep draining in the background. Strategies routing by
+// shard index see every shard after a removed one shift by one position.
+func (s *ShardManager) ReplaceTopology(ctx context.Context, shards []ShardConfig) error {
+	return s.changeTopology(ctx, func(*topology) ([]ShardConfig, error) {
+		return shards, nil
+	})
+}
+
+// changeTopology replaces the shard layout with the shards layout returns for
+// the current topology. The change is made under topoMu; subscribers are
+// notified and removed pools drained once it is released.
+func (s *ShardManager) changeTopology(ctx context.Context, layout func(t *topology) ([]ShardConfig, error)) error {
+	t, removed, err := func() (*topology, []*pgxpool.Pool, error) {
+		s.topoMu.Lock()
+		defer s.topoMu.Unlock()
+
+		if s.Transition(ctx) != PhaseStable {
+			return nil, nil, ErrTransitionInProgress
+		}
+
+		prev := s.topology()
+		shards, err := layout(prev)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		t, removed, err := buildTopology(ctx, shards, prev)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		s.swapTopology(t)
+		return t, removed, nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	s.notify(t)
+	drainPools(ctx, removed)
+
+	return nil
+}
+
+// swapTopology installs t as the current topology, ending any transition.
+// Subscribers must then be notified with notify.
+func (s *ShardManager) swapTopology(t *topology) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.topo = t
+	s.next = nil
+	s.phase = PhaseStable
+}
+
+// notify calls the subscribers with t. It must not be called with topoMu
+// held, since subscribers may change the topology.
+func (s *ShardManager) notify(t *topology) {
+	s.mu.RLock()
+	subscribers := make([]func(Topology), 0, len(s.subscribers))
+	for _, f := range s.subscribers {
+		subscribers = append(subscribers, f)
+	}
+	s.mu.RUnlock()
+
+	for _, f := range subscribers {
+		f(t.public())
+	}
+}
+
+// drainPools closes pools, waiting until their acquired connections are
+// released or ctx is done.
+func drainPools(ctx context.Context, pools []*pgxpool.Pool) {
+	if len(pools) == 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		closePools(pools)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// ShardMapping routes keys to shards with a fixed set of shards and the shard
+// strategy of the ShardManager it was taken from. Mappings taken before and
+// after a topology change describe where keys used to live and where they
+// live now; see Migrate.
+type ShardMapping struct {
+	topo      *topology
+	indexFunc ShardIndexContextFunc
+	idFunc    ShardIDFunc
+}
+
+// Mapping returns the mapping of the current topology.
+func (s *ShardManager) Mapping(ctx context.Context) *ShardMapping {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return &ShardMapping{topo: s.topo, indexFunc: s.shardIndexFunc, idFunc: s.shardIDFunc}
+}
+
+// MappingFor returns the mapping of a topology made of the current shards with
+// the provided IDs, in their current order. It is used to plan the removal of
+// shards, whose rows must be moved before RemoveShard is called.
+func (s *ShardManager) MappingFor(ctx context.Context, ids []string) (*ShardMapping, error) {
+	m := s.Mapping(ctx)
+
+	keep := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if _, ok := m.topo.indexes[id]; !ok {
+			return nil, fmt.Errorf("shard %q not found", id)
+		}
+		keep[id] = true
+	}
+
+	var shards []ShardConfig
+	for _, shard := range m.topo.configs {
+		if keep[shard.ID] {
+			shards = append(shards, shard)
+		}
+	}
+
+	t := &topology{
+		version:   m.topo.version,
+		configs:   shards,
+		pools:     make([]*pgxpool.Pool, len(shards)),
+		replicas:  make([]*replicaSet, len(shards)),
+		ids:       make([]string, len(shards)),
+		indexes:   make(map[string]int, len(shards)),
+		primaries: make([]string, len(shards)),
+	}
+	for i, shard := range shards {
+		j := m.topo.indexes[shard.ID]
+		t.pools[i] = m.topo.pools[j]
+		t.replicas[i] = m.topo.replicas[j]
+		t.primaries[i] = m.topo.primaries[j]
+		t.ids[i] = shard.ID
+		t.indexes[shard.ID] = i
+	}
+	m.topo = t
+
+	return m, nil
+}
+
+// ShardID returns the ID of the shard for key in the mapping.
+func (m *ShardMapping) ShardID(ctx context.Context, key any) (string, error) {
+	index, err := m.topo.locate(ctx, key, m.indexFunc, m.idFunc)
+	if err != nil {
+		return "", err
+	}
+
+	return m.topo.ids[index], nil
+}
+
+// ShardIDs returns the IDs of the shards in the mapping.
+func (m *ShardMapping) ShardIDs() []string {
+	return append([]string(nil), m.topo.ids...)
+}
+
+// pool returns the pool of the shard with the provided ID.
+func (m *ShardMapping) pool(id string) (*pgxpool.Pool, error) {
+	index, ok := m.topo.indexes[id]
+	if !ok {
+		return nil, fmt.Errorf("shard %q not found", id)
+	}
+
+	return m.topo.pools[index], nil
+}
@@ -0,0 +1,51 @@
+package pgxshard
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testConnString points to a server that is never contacted: pools connect
+// lazily and the tests only change the layout.
+const testConnString = "postgres://localhost:1/test"
+
+func TestSubscriberChangesTopology(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewWithConfig(ctx, []ShardConfig{{ID: "a", ConnString: testConnString}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(ctx)
+
+	versions := make(chan uint64, 2)
+	s.Subscribe(ctx, func(topo Topology) {
+		versions <- topo.Version
+		if len(topo.Shards) == 2 {
+			if err := s.AddShard(ctx, ShardConfig{ID: "c", ConnString: testConnString}); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.AddShard(ctx, ShardConfig{ID: "b", ConnString: testConnString})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddShard from a subscriber deadlocked")
+	}
+
+	if got := s.ShardIDs(ctx); len(got) != 3 {
+		t.Errorf("ShardIDs() = %v, want [a b c]", got)
+	}
+	if v1, v2 := <-versions, <-versions; v1 != 1 || v2 != 2 {
+		t.Errorf("notified versions %d and %d, want 1 and 2", v1, v2)
+	}
+}
@@ -0,0 +1,265 @@
+package pgxshard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrTransitionInProgress is returned when the topology is changed while a
+// transition is in progress, and ErrNoTransition when a transition is
+// advanced or aborted while none is in progress.
+var (
+	ErrTransitionInProgress = errors.New("topology transition in progress")
+	ErrNoTransition         = errors.New("no topology transition in progress")
+)
+
+// TransitionPhase is the phase of a topology transition.
+type TransitionPhase int
+
+const (
+	// PhaseStable routes reads and writes to the current topology.
+	PhaseStable TransitionPhase = iota
+	// PhaseDualWrite routes writes to the shards of both the old and the new
+	// topology, and reads to the old topology.
+	PhaseDualWrite
+	// PhaseReadNew routes writes to the shards of both topologies, and reads
+	// to the new topology.
+	PhaseReadNew
+)
+
+// String returns the name of the phase.
+func (p TransitionPhase) String() string {
+	switch p {
+	case PhaseStable:
+		return "stable"
+	case PhaseDualWrite:
+		return "dual-write"
+	case PhaseReadNew:
+		return "read-new"
+	}
+	return "unknown"
+}
+
+// BeginTransition starts moving to the provided shard layout without downtime.
+// It opens the pools of new shards and enters PhaseDualWrite, in which writes
+// go to both the old and the new shard of a key while reads are still served
+// by the old one. Rows are then copied with Migrate using the mappings
+// returned by TransitionMappings, and the transition is completed by calling
+// AdvanceTransition twice.
+func (s *ShardManager) BeginTransition(ctx context.Context, shards []ShardConfig) error {
+	s.topoMu.Lock()
+	defer s.topoMu.Unlock()
+
+	if s.Transition(ctx) != PhaseStable {
+		return ErrTransitionInProgress
+	}
+
+	next, _, err := buildTopology(ctx, shards, s.topology())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.next = next
+	s.phase = PhaseDualWrite
+	s.mu.Unlock()
+
+	return nil
+}
+
+// AdvanceTransition moves the transition to its next phase and returns it.
+// From PhaseDualWrite it moves to PhaseReadNew, flipping reads to the new
+// layout. From PhaseReadNew it completes the transition: the new layout
+// becomes the current topology, subscribers are notified and the pools of
+// removed shards are drained and closed.
+func (s *ShardManager) AdvanceTransition(ctx context.Context) (TransitionPhase, error) {
+	s.topoMu.Lock()
+
+	s.mu.Lock()
+	switch s.phase {
+	case PhaseDualWrite:
+		s.phase = PhaseReadNew
+		s.mu.Unlock()
+		s.topoMu.Unlock()
+		return PhaseReadNew, nil
+	case PhaseReadNew:
+		t, next := s.topo, s.next
+		s.mu.Unlock()
+
+		s.swapTopology(next)
+		s.topoMu.Unlock()
+
+		s.notify(next)
+		drainPools(ctx, t.unshared(next))
+		return PhaseStable, nil
+	}
+	s.mu.Unlock()
+	s.topoMu.Unlock()
+
+	return PhaseStable, ErrNoTransition
+}
+
+// AbortTransition abandons the transition in progress, returning reads and
+// writes to the old layout and closing the pools opened for new shards. Rows
+// already written to new shards are left in place.
+func (s *ShardManager) AbortTransition(ctx context.Context) error {
+	s.topoMu.Lock()
+	defer s.topoMu.Unlock()
+
+	s.mu.Lock()
+	if s.phase == PhaseStable {
+		s.mu.Unlock()
+		return ErrNoTransition
+	}
+	t, next := s.topo, s.next
+	s.next = nil
+	s.phase = PhaseStable
+	s.mu.Unlock()
+
+	drainPools(ctx, next.unshared(t))
+	return nil
+}
+
+// Transition returns the phase of the topology transition in progress, or
+// PhaseStable if there is none.
+func (s *ShardManager) Transition(ctx context.Context) TransitionPhase {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.phase
+}
+
+// TransitionMappings returns the mappings of the old and the new layout of the
+// transition in progress, to be passed to Migrate.
+func (s *ShardManager) TransitionMappings(ctx context.Context) (*ShardMapping, *ShardMapping, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.phase == PhaseStable {
+		return nil, nil, ErrNoTransition
+	}
+
+	from := &ShardMapping{topo: s.topo, indexFunc: s.shardIndexFunc, idFunc: s.shardIDFunc}
+	to := &ShardMapping{topo: s.next, indexFunc: s.shardIndexFunc, idFunc: s.shardIDFunc}
+	return from, to, nil
+}
+
+// ShardsForWrite returns the database shards writes for the provided key must
+// go to in the current transition phase. Outside of a transition, or if the
+// key does not move, it returns a single shard. Otherwise the first shard is
+// the one reads are currently served from. If one of the shards is
+// quarantined by the health checker, it returns a *ShardUnavailableError.
+func (s *ShardManager) ShardsForWrite(ctx context.Context, key any) ([]*pgxpool.Pool, error) {
+	targets, err := s.writeTargets(ctx, s.writeRouting(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	pools := make([]*pgxpool.Pool, len(targets))
+	for i, target := range targets {
+		pools[i] = target.pool
+	}
+	return pools, nil
+}
+
+// writeRoute is a snapshot of the routing of writes.
+type writeRoute struct {
+	// t is the topology reads are served from, and next the other topology
+	// of the current transition, if any.
+	t, next   *topology
+	indexFunc ShardIndexContextFunc
+	idFunc    ShardIDFunc
+}
+
+// writeRouting returns the current routing of writes.
+func (s *ShardManager) writeRouting() writeRoute {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w := writeRoute{t: s.topo, indexFunc: s.shardIndexFunc, idFunc: s.shardIDFunc}
+	switch s.phase {
+	case PhaseDualWrite:
+		w.next = s.next
+	case PhaseReadNew:
+		w.t, w.next = s.next, s.topo
+	}
+	return w
+}
+
+// locate returns the index in w.t of the shard writes for key go to. It
+// returns ErrTransitionInProgress if the key moves between shards in the
+// transition, since writes must then go to both shards.
+func (w writeRoute) locate(ctx context.Context, key any) (int, error) {
+	index, err := w.t.locate(ctx, key, w.indexFunc, w.idFunc)
+	if err != nil {
+		return 0, err
+	}
+
+	if w.next != nil {
+		j, err := w.next.locate(ctx, key, w.indexFunc, w.idFunc)
+		if err != nil {
+			return 0, err
+		}
+		if w.next.pools[j] != w.t.pools[index] {
+			return 0, fmt.Errorf("key moves from shard %s to shard %s: %w", w.t.ids[index], w.next.ids[j], ErrTransitionInProgress)
+		}
+	}
+
+	return index, nil
+}
+
+// writeTarget is a shard a write is sent to.
+type writeTarget struct {
+	id   string
+	pool *pgxpool.Pool
+}
+
+// writeTargets returns the shards writes for key go to with the routing w:
+// the shard reads are served from and, if the key moves in the transition,
+// its other shard. It returns a *ShardUnavailableError if one of the shards
+// is quarantined by the health checker.
+func (s *ShardManager) writeTargets(ctx context.Context, w writeRoute, key any) ([]writeTarget, error) {
+	index, err := w.t.locate(ctx, key, w.indexFunc, w.idFunc)
+	if err != nil {
+		return nil, err
+	}
+	targets := []writeTarget{{id: w.t.ids[index], pool: w.t.pools[index]}}
+
+	if w.next != nil {
+		j, err := w.next.locate(ctx, key, w.indexFunc, w.idFunc)
+		if err != nil {
+			return nil, err
+		}
+		if w.next.pools[j] != targets[0].pool {
+			targets = append(targets, writeTarget{id: w.next.ids[j], pool: w.next.pools[j]})
+		}
+	}
+
+	for _, target := range targets {
+		if err := s.checkAvailable(target.id); err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+// locateWrite returns the topology reads are served from and the index in it
+// of the shard writes for key go to. It returns ErrTransitionInProgress if
+// the key moves between shards in the current transition, and a
+// *ShardUnavailableError if the shard is quarantined by the health checker.
+func (s *ShardManager) locateWrite(ctx context.Context, key any) (*topology, int, error) {
+	w := s.writeRouting()
+
+	index, err := w.locate(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := s.checkAvailable(w.t.ids[index]); err != nil {
+		return nil, 0, err
+	}
+	return w.t, index, nil
+}
@@ -0,0 +1,88 @@
+package pgxshard
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// TxOptions configures WithTx.
+type TxOptions struct {
+	pgx.TxOptions
+	// MaxAttempts is the number of times the transaction is run before a
+	// serialization failure or deadlock is returned. Defaults to 3.
+	MaxAttempts int
+	// MinBackoff is the base delay before the first retry, doubled on every
+	// following retry up to MaxBackoff. The actual delay is picked at random
+	// up to that value. Default to 10 milliseconds and 1 second respectively.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// WithTx runs fn in a transaction on the shard for key, committing it if fn
+// returns nil and rolling it back otherwise. The transaction is retried from
+// scratch, with backoff, when it fails with a serialization failure or a
+// deadlock, so fn must not have side effects outside the transaction.
+//
+// During a topology transition, WithTx returns an error matching
+// ErrTransitionInProgress for keys that move between shards, as a single
+// transaction cannot write to both. Errors of the transaction are returned as
+// a *ShardError and passed to ObserveError.
+func (s *ShardManager) WithTx(ctx context.Context, key any, opts TxOptions, fn func(pgx.Tx) error) error {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 3
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 10 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Second
+	}
+
+	backoff := opts.MinBackoff
+	for attempt := 1; ; attempt++ {
+		// Route on every attempt, the shard may have failed over meanwhile.
+		t, index, err := s.locateWrite(ctx, key)
+		if err != nil {
+			return err
+		}
+		id := t.ids[index]
+
+		err = pgx.BeginTxFunc(ctx, t.pools[index], opts.TxOptions, fn)
+		if err == nil {
+			return nil
+		}
+		s.ObserveError(ctx, id, err)
+
+		if attempt >= opts.MaxAttempts || !isRetryableError(err) {
+			return &ShardError{ShardID: id, Err: err}
+		}
+
+		select {
+		case <-ctx.Done():
+			return &ShardError{ShardID: id, Err: err}
+		case <-time.After(rand.N(backoff) + 1):
+		}
+		backoff = min(2*backoff, opts.MaxBackoff)
+	}
+}
+
+// isRetryableError reports whether err is a serialization failure or a
+// deadlock, after which the transaction can be run again.
+func isRetryableError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	switch pgErr.Code {
+	case "40001", // serialization_failure
+		"40P01": // deadlock_detected
+		return true
+	}
+	return false
+}